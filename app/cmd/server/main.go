@@ -1,15 +1,25 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	httpapi "newsletter/internal/http"
 	"newsletter/internal/store"
 	"newsletter/internal/jobs"
 	"newsletter/internal/mail"
 	"newsletter/internal/deliverability"
+	"newsletter/internal/tracking"
 
 	"github.com/sirupsen/logrus"
 	"github.com/joho/godotenv"
@@ -29,27 +39,99 @@ func main() {
 	dsn := getEnv("DATABASE_URL", "sqlite:///var/app/newsletter.db")
 	port := getEnv("PORT", "8080")
 	licenseKey := getEnv("LICENSE_KEY", "")
+	shutdownTimeout := getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+	workerConcurrency := getEnv("WORKER_CONCURRENCY", "sending=8,bounces=2,maintenance=1,default=1")
+	sendBatchSize := getEnvInt("SEND_BATCH_SIZE", jobs.DefaultBatchSize)
+	dkimRetireGrace := getEnvDuration("DKIM_ROTATION_GRACE", jobs.DefaultDKIMRetireGrace)
+	publicBaseURL := getEnv("PUBLIC_BASE_URL", "http://localhost:"+port)
 
 	if licenseKey == "" {
 		logrus.Fatal("LICENSE_KEY environment variable is required")
 	}
 
+	concurrency, err := jobs.ParseConcurrency(workerConcurrency)
+	if err != nil {
+		logrus.Fatalf("Invalid WORKER_CONCURRENCY: %v", err)
+	}
+	baseURL, err := parseBaseURL(publicBaseURL)
+	if err != nil {
+		logrus.Fatalf("Invalid PUBLIC_BASE_URL: %v", err)
+	}
+	trustedProxies, err := parseTrustedProxies(getEnv("TRUSTED_PROXIES", ""))
+	if err != nil {
+		logrus.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
+
 	// Initialize database
 	db, err := store.Open(dsn)
 	if err != nil {
 		logrus.Fatalf("Failed to open database: %v", err)
 	}
-	defer db.Close()
 
 	// Run migrations
 	if err := store.Migrate(db.DB()); err != nil {
 		logrus.Fatalf("Failed to run migrations: %v", err)
 	}
 
+	// Stop on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Background loops other than the workers; they use the database and
+	// the transports, so shutdown waits for them before closing those
+	var background sync.WaitGroup
+	runBackground := func(run func()) {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			run()
+		}()
+	}
+
 	// Initialize services
-	queue := jobs.NewQueue(db)
+	transport, err := newTransport(getEnv("MAIL_TRANSPORT", "smtp"))
+	if err != nil {
+		logrus.Fatalf("Failed to set up mail transport: %v", err)
+	}
+	if relays := getEnv("MAIL_RELAYS", ""); relays != "" {
+		router, err := newRouter(relays, getEnv("MAIL_ROUTES", ""))
+		if err != nil {
+			logrus.Fatalf("Failed to set up mail relays: %v", err)
+		}
+		interval := getEnvDuration("RELAY_HEALTH_CHECK_INTERVAL", 30*time.Second)
+		runBackground(func() { router.RunHealthChecks(ctx, interval) })
+		transport = router
+	}
+	throttle, err := newThrottle()
+	if err != nil {
+		logrus.Fatalf("Failed to set up send throttling: %v", err)
+	}
+	// Without TRACKING_SECRET a secret is generated once and kept in the
+	// database, so links in mail already sent keep working across restarts
+	trackingSecret := getEnv("TRACKING_SECRET", "")
+	if trackingSecret == "" {
+		generated, err := tracking.GenerateSecret()
+		if err != nil {
+			logrus.Fatalf("Failed to generate tracking secret: %v", err)
+		}
+		if trackingSecret, err = db.EnsureSetting("tracking_secret", generated); err != nil {
+			logrus.Fatalf("Failed to load tracking secret: %v", err)
+		}
+	}
+	signer := tracking.NewSigner(trackingSecret)
+	recorder := tracking.NewRecorder(db, getEnvInt("EVENT_BUFFER_SIZE", tracking.DefaultRecorderBuffer))
+	go recorder.Run()
 	mailService := mail.NewService()
+	mailService.Transport = transport
+	mailService.Throttle = throttle
+	mailService.Tracking = signer
+	mailService.BaseURL = baseURL.String()
+	mailService.UnsubscribeMailbox = getEnv("UNSUBSCRIBE_MAILBOX", mail.DefaultUnsubscribeMailbox)
+	queue := jobs.NewQueue(db, mailService)
 	deliverabilityService := deliverability.NewService()
+	deliverabilityService.TrackingTarget = baseURL.Hostname()
+	deliverabilityService.TrackingTLS = baseURL.Scheme == "https"
+	rotator := jobs.NewDKIMRotator(queue, deliverabilityService, dkimRetireGrace)
 	
 	// Create service container
 	services := &httpapi.Services{
@@ -57,16 +139,65 @@ func main() {
 		Queue: queue,
 		Mail: mailService,
 		Deliverability: deliverabilityService,
+		DKIMRotator: rotator,
+		Tracking: signer,
+		Events: recorder,
 		LicenseKey: licenseKey,
+		TrustedProxies: trustedProxies,
 	}
 
-	// Start background workers
-	handlers := map[string]jobs.JobHandler{
-		"send_batch": queue.SendBatchHandler,
-		"process_bounce": queue.BounceProcessingHandler,
-		"rotate_dkim": queue.DKIMRotationHandler,
+	// Register job handlers with their retry policies. Campaigns are planned
+	// into send batches ahead of the batches themselves on the sending queue
+	planner := jobs.NewCampaignPlanner(queue, sendBatchSize)
+	queue.Register("plan_campaign", planner.PlanCampaignHandler, jobs.RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   30 * time.Second,
+		MaxDelay:    10 * time.Minute,
+		Jitter:      0.2,
+	}, jobs.WithQueue("sending"), jobs.WithPriority(10))
+	queue.Register("send_batch", queue.SendBatchHandler, jobs.RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   time.Minute,
+		MaxDelay:    30 * time.Minute,
+		Jitter:      0.2,
+	}, jobs.WithQueue("sending"))
+	queue.Register("process_bounce", queue.BounceProcessingHandler, jobs.RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   10 * time.Second,
+		MaxDelay:    5 * time.Minute,
+		Jitter:      0.2,
+	}, jobs.WithQueue("bounces"))
+	queue.Register("rotate_dkim", rotator.DKIMRotationHandler, jobs.RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   5 * time.Minute,
+		MaxDelay:    time.Hour,
+		Jitter:      0.1,
+	}, jobs.WithQueue("maintenance"))
+	queue.Register("cleanup_jobs", queue.CleanupJobsHandler, jobs.DefaultRetryPolicy, jobs.WithQueue("maintenance"))
+
+	// Move campaigns to sent or failed as their jobs finish
+	queue.OnFinish("plan_campaign", planner.JobFinished)
+	queue.OnFinish("send_batch", planner.JobFinished)
+
+	// Free the pending key of a rotation whose job was dead-lettered
+	queue.OnFinish("rotate_dkim", rotator.JobFinished)
+
+	// Built-in recurring jobs; further schedules are managed via /api/schedules
+	scheduler := jobs.NewScheduler(queue)
+	if err := scheduler.Ensure("cleanup-jobs", "30 3 * * *", "cleanup_jobs", jobs.CleanupJobsPayload{OlderThanDays: 30}); err != nil {
+		logrus.Errorf("Failed to create cleanup schedule: %v", err)
 	}
-	go queue.RunWorkers(4, handlers)
+
+	// Requeue jobs interrupted by a previous crash before our own workers
+	// start claiming, then keep reaping jobs whose lease expires
+	if n, err := queue.RecoverOrphanedJobs(); err != nil {
+		logrus.Errorf("Failed to recover orphaned jobs: %v", err)
+	} else if n > 0 {
+		logrus.Infof("Recovered %d orphaned jobs", n)
+	}
+	queue.RunWorkers(ctx, concurrency)
+	runBackground(func() { queue.RunReaper(ctx, time.Minute) })
+	runBackground(func() { scheduler.Run(ctx) })
 
 	// Setup HTTP routes
 	mux := httpapi.NewRouter(services)
@@ -76,8 +207,183 @@ func main() {
 	mux.PathPrefix("/").Handler(fs)
 
 	// Start server
-	logrus.Infof("Starting server on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, mux))
+	server := &http.Server{
+		Addr:    ":" + port,
+		Handler: mux,
+	}
+	go func() {
+		logrus.Infof("Starting server on port %s", port)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logrus.Fatalf("Server failed: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	logrus.Infof("Shutting down, draining for up to %s", shutdownTimeout)
+
+	// Workers already stopped claiming when ctx was cancelled; give HTTP
+	// requests and in-flight jobs until the deadline to finish
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logrus.Warnf("HTTP server did not shut down cleanly: %v", err)
+		server.Close()
+	}
+	if err := queue.Shutdown(shutdownCtx); err != nil {
+		logrus.Warnf("Workers did not drain cleanly: %v", err)
+	}
+	backgroundDone := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(backgroundDone)
+	}()
+	// They stopped starting new work when ctx was cancelled, so this only
+	// waits out the pass each may be in the middle of
+	select {
+	case <-backgroundDone:
+	case <-time.After(5 * time.Second):
+		logrus.Warn("Reaper, scheduler or relay health checks did not stop in time")
+	}
+	if err := mailService.Close(); err != nil {
+		logrus.Warnf("Failed to close mail transport: %v", err)
+	}
+	if err := recorder.Shutdown(shutdownCtx); err != nil {
+		logrus.Warnf("Tracking events were not all written: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		logrus.Errorf("Failed to close database: %v", err)
+	}
+
+	logrus.Info("Shutdown complete")
+}
+
+// newTransport builds the mail transport selected by MAIL_TRANSPORT: an SMTP
+// relay, the local sendmail program, or a Maildir or .eml directory for
+// staging environments without an MTA.
+func newTransport(kind string) (mail.Transport, error) {
+	switch kind {
+	case "smtp":
+		transport := mail.NewSMTPTransport(
+			getEnv("SMTP_HOST", "localhost"),
+			getEnv("SMTP_PORT", "587"),
+			getEnv("SMTP_USERNAME", ""),
+			getEnv("SMTP_PASSWORD", ""),
+			getEnv("SMTP_TLS", mail.TLSStartTLS),
+		)
+		configurePool(transport)
+		return transport, nil
+	case "sendmail":
+		return mail.NewSendmailTransport(getEnv("SENDMAIL_PATH", mail.DefaultSendmailPath)), nil
+	case "maildir":
+		return mail.NewFileTransport(getEnv("MAIL_DIR", "/var/app/mail"), true)
+	case "file":
+		return mail.NewFileTransport(getEnv("MAIL_DIR", "/var/app/mail"), false)
+	default:
+		return nil, fmt.Errorf("unknown MAIL_TRANSPORT %q (want smtp, sendmail, maildir or file)", kind)
+	}
+}
+
+// newRouter builds a relay router from MAIL_RELAYS and MAIL_ROUTES. It
+// replaces the MAIL_TRANSPORT transport when relays are configured.
+func newRouter(relaySpec, routeSpec string) (*mail.Router, error) {
+	relays, err := mail.ParseRelays(relaySpec)
+	if err != nil {
+		return nil, err
+	}
+	for _, relay := range relays {
+		if t, ok := relay.Transport.(*mail.SMTPTransport); ok {
+			configurePool(t)
+		}
+	}
+
+	routes, err := mail.ParseRoutes(routeSpec, relays)
+	if err != nil {
+		return nil, err
+	}
+
+	router := mail.NewRouter(relays, routes)
+	router.FailureThreshold = getEnvInt("RELAY_FAILURE_THRESHOLD", mail.DefaultRelayFailureThreshold)
+	router.Cooldown = getEnvDuration("RELAY_COOLDOWN", mail.DefaultRelayCooldown)
+	return router, nil
+}
+
+// newThrottle builds the send rate limits. Rates are given like 10/s,
+// 300/m or 5000/h; unset limits are unlimited.
+func newThrottle() (*mail.Throttle, error) {
+	var config mail.ThrottleConfig
+	var err error
+	if config.Global, err = mail.ParseRateLimit(getEnv("THROTTLE_GLOBAL", "")); err != nil {
+		return nil, err
+	}
+	if config.Domain, err = mail.ParseRateLimit(getEnv("THROTTLE_PER_DOMAIN", "")); err != nil {
+		return nil, err
+	}
+	if config.Domains, err = mail.ParseRateLimits(getEnv("THROTTLE_DOMAINS", "")); err != nil {
+		return nil, err
+	}
+	if config.MX, err = mail.ParseRateLimit(getEnv("THROTTLE_PER_MX", "")); err != nil {
+		return nil, err
+	}
+	if config.MXProviders, err = mail.ParseRateLimits(getEnv("THROTTLE_MX_PROVIDERS", "")); err != nil {
+		return nil, err
+	}
+	return mail.NewThrottle(config), nil
+}
+
+// parseBaseURL checks that raw is an absolute http(s) URL without query or
+// fragment and strips its trailing slash, so paths can be appended to it.
+func parseBaseURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an absolute http or https URL", raw)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("%q has a query or fragment", raw)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = ""
+	return u, nil
+}
+
+// parseTrustedProxies parses a comma-separated list of CIDRs and single
+// addresses, e.g. "10.0.0.0/8,127.0.0.1".
+func parseTrustedProxies(spec string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func configurePool(t *mail.SMTPTransport) {
+	t.MaxConns = getEnvInt("SMTP_MAX_CONNS", mail.DefaultSMTPMaxConns)
+	t.MaxMessagesPerConn = getEnvInt("SMTP_MAX_MESSAGES_PER_CONN", mail.DefaultSMTPMaxMessagesPerConn)
+	t.IdleTimeout = getEnvDuration("SMTP_IDLE_TIMEOUT", mail.DefaultSMTPIdleTimeout)
 }
 
 func getEnv(key, defaultValue string) string {
@@ -86,3 +392,31 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		logrus.Warnf("Invalid integer for %s (%q), using %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		logrus.Warnf("Invalid duration for %s (%q), using %s", key, value, defaultValue)
+		return defaultValue
+	}
+	return d
+}
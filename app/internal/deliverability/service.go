@@ -7,12 +7,18 @@ import (
 	"strings"
 	"time"
 
+	"newsletter/internal/mail"
 	"newsletter/internal/store"
 	"github.com/sirupsen/logrus"
 )
 
 type Service struct {
-	// Add any configuration or dependencies here
+	// TrackingTarget is the server's public host, which domains' tracking
+	// hosts must be CNAMEs of
+	TrackingTarget string
+	// TrackingTLS is set when links are https, so tracking hosts also
+	// need a valid certificate
+	TrackingTLS bool
 }
 
 func NewService() *Service {
@@ -20,14 +26,16 @@ func NewService() *Service {
 }
 
 type DomainStatus struct {
-	Domain     string            `json:"domain"`
-	SPF        CheckResult       `json:"spf"`
-	DKIM       CheckResult       `json:"dkim"`
-	DMARC      CheckResult       `json:"dmarc"`
-	PTR        CheckResult       `json:"ptr"`
-	TLS        CheckResult       `json:"tls"`
-	Overall    string            `json:"overall"`
-	Checks     map[string]bool   `json:"checks"`
+	Domain      string            `json:"domain"`
+	SPF         CheckResult       `json:"spf"`
+	DKIM        CheckResult       `json:"dkim"`
+	DKIMEd25519 *CheckResult      `json:"dkim_ed25519,omitempty"`
+	Tracking    *CheckResult      `json:"tracking,omitempty"`
+	DMARC       CheckResult       `json:"dmarc"`
+	PTR         CheckResult       `json:"ptr"`
+	TLS         CheckResult       `json:"tls"`
+	Overall     string            `json:"overall"`
+	Checks      map[string]bool   `json:"checks"`
 }
 
 type CheckResult struct {
@@ -52,7 +60,7 @@ func (s *Service) CheckDomainStatus(domain *store.Domain) (*DomainStatus, error)
 	status.Checks["spf"] = spfResult.Status == "pass"
 
 	// Check DKIM record
-	dkimResult, err := s.checkDKIM(domain.Domain, domain.DKIMSelector, domain.DKIMPublicKey)
+	dkimResult, err := s.CheckDKIM(domain.Domain, domain.DKIMSelector, domain.DKIMPublicKey)
 	if err != nil {
 		logrus.Errorf("DKIM check failed for %s: %v", domain.Domain, err)
 		dkimResult = CheckResult{Status: "fail", Message: "DKIM check failed", Details: err.Error()}
@@ -60,6 +68,33 @@ func (s *Service) CheckDomainStatus(domain *store.Domain) (*DomainStatus, error)
 	status.DKIM = dkimResult
 	status.Checks["dkim"] = dkimResult.Status == "pass"
 
+	// Check the Ed25519 DKIM record, if the domain has one
+	if domain.DKIMEd25519Selector != "" {
+		edResult, err := s.CheckDKIM(domain.Domain, domain.DKIMEd25519Selector, domain.DKIMEd25519PublicKey)
+		if err != nil {
+			logrus.Errorf("Ed25519 DKIM check failed for %s: %v", domain.Domain, err)
+			edResult = CheckResult{Status: "fail", Message: "DKIM check failed", Details: err.Error()}
+		}
+		status.DKIMEd25519 = &edResult
+		status.Checks["dkim_ed25519"] = edResult.Status == "pass"
+	}
+
+	// Check the tracking host's CNAME, if the domain has one
+	if domain.TrackingHost != "" {
+		trackingResult, err := s.checkTrackingHost(domain.TrackingHost)
+		if err != nil {
+			logrus.Errorf("Tracking host check failed for %s: %v", domain.Domain, err)
+			trackingResult = CheckResult{Status: "fail", Message: "Tracking host check failed", Details: err.Error()}
+		}
+		if trackingResult.Status == "pass" && s.TrackingTLS {
+			if tlsResult := s.checkTLS(domain.TrackingHost); tlsResult.Status != "pass" {
+				trackingResult = CheckResult{Status: "fail", Message: "Tracking host has no valid TLS certificate: " + tlsResult.Message, Details: tlsResult.Details}
+			}
+		}
+		status.Tracking = &trackingResult
+		status.Checks["tracking"] = trackingResult.Status == "pass"
+	}
+
 	// Check DMARC record
 	dmarcResult, err := s.checkDMARC(domain.Domain, domain.DMARCRecord)
 	if err != nil {
@@ -120,7 +155,9 @@ func (s *Service) checkSPF(domain, expectedSPF string) (CheckResult, error) {
 	return CheckResult{Status: "pass", Message: "SPF record is valid"}, nil
 }
 
-func (s *Service) checkDKIM(domain, selector, publicKey string) (CheckResult, error) {
+// CheckDKIM looks up the DKIM record of selector and checks that it publishes
+// publicKey.
+func (s *Service) CheckDKIM(domain, selector, publicKey string) (CheckResult, error) {
 	// Look up DKIM record
 	dkimDomain := fmt.Sprintf("%s._domainkey.%s", selector, domain)
 	records, err := net.LookupTXT(dkimDomain)
@@ -132,17 +169,80 @@ func (s *Service) checkDKIM(domain, selector, publicKey string) (CheckResult, er
 		return CheckResult{Status: "fail", Message: "No DKIM record found"}, nil
 	}
 
-	// Check if the public key matches (simplified check)
+	// Check if the public key matches
 	dkimRecord := records[0]
 	if !strings.Contains(dkimRecord, "v=DKIM1") {
 		return CheckResult{Status: "fail", Message: "Invalid DKIM record format"}, nil
 	}
 
-	// In a real implementation, you'd parse the DKIM record and compare the public key
-	// For now, we'll just check if the record exists and has the right format
+	expected, err := mail.DKIMRecord(publicKey)
+	if err != nil {
+		return CheckResult{Status: "fail", Message: "Invalid DKIM public key"}, err
+	}
+	if dkimTag(dkimRecord, "p") != dkimTag(expected, "p") {
+		return CheckResult{
+			Status:  "fail",
+			Message: "DKIM record doesn't match the domain's public key",
+			Details: fmt.Sprintf("Expected: %s\nFound: %s", expected, dkimRecord),
+		}, nil
+	}
+	if dkimTag(dkimRecord, "k") != dkimTag(expected, "k") {
+		return CheckResult{Status: "fail", Message: "DKIM record has the wrong key type"}, nil
+	}
+
 	return CheckResult{Status: "pass", Message: "DKIM record is valid"}, nil
 }
 
+// dkimTag returns the value of tag in a DKIM record with whitespace
+// removed. A missing k= tag defaults to rsa.
+func dkimTag(record, tag string) string {
+	for _, part := range strings.Split(record, ";") {
+		name, value, ok := strings.Cut(part, "=")
+		if ok && strings.TrimSpace(name) == tag {
+			return strings.Join(strings.Fields(value), "")
+		}
+	}
+	if tag == "k" {
+		return "rsa"
+	}
+	return ""
+}
+
+// checkTrackingHost checks that host is a CNAME of the server's public host,
+// so that tracking and unsubscribe links on it reach the server.
+func (s *Service) checkTrackingHost(host string) (CheckResult, error) {
+	cname, err := net.LookupCNAME(host)
+	if err != nil {
+		return CheckResult{Status: "fail", Message: "Failed to lookup tracking host CNAME"}, err
+	}
+
+	cname = strings.TrimSuffix(cname, ".")
+	if strings.EqualFold(cname, host) {
+		return CheckResult{Status: "fail", Message: "No CNAME record found for tracking host"}, nil
+	}
+	// LookupCNAME follows the whole chain, so a target that is itself an
+	// alias, e.g. of a load balancer, is compared by its canonical name too
+	if s.TrackingTarget != "" && !strings.EqualFold(cname, s.TrackingTarget) && !strings.EqualFold(cname, s.canonicalTarget()) {
+		return CheckResult{
+			Status:  "fail",
+			Message: "Tracking host CNAME doesn't point to the server",
+			Details: fmt.Sprintf("Expected: %s\nFound: %s", s.TrackingTarget, cname),
+		}, nil
+	}
+
+	return CheckResult{Status: "pass", Message: "Tracking host CNAME is valid"}, nil
+}
+
+// canonicalTarget returns the canonical name of TrackingTarget, or "" if it
+// can't be resolved.
+func (s *Service) canonicalTarget() string {
+	cname, err := net.LookupCNAME(s.TrackingTarget)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSuffix(cname, ".")
+}
+
 func (s *Service) checkDMARC(domain, expectedDMARC string) (CheckResult, error) {
 	// Look up DMARC record
 	dmarcDomain := fmt.Sprintf("_dmarc.%s", domain)
@@ -319,10 +419,17 @@ func (s *Service) GetRequiredDNSRecords(domain *store.Domain) map[string]string
 	// SPF record
 	records["SPF"] = domain.SPFRecord
 	
-	// DKIM record
-	dkimDomain := fmt.Sprintf("%s._domainkey.%s", domain.DKIMSelector, domain.Domain)
-	records["DKIM"] = fmt.Sprintf("%s: %s", dkimDomain, domain.DKIMPublicKey)
+	// DKIM records
+	records["DKIM"] = dkimDNSRecord(domain.Domain, domain.DKIMSelector, domain.DKIMPublicKey)
+	if domain.DKIMEd25519Selector != "" {
+		records["DKIM_ED25519"] = dkimDNSRecord(domain.Domain, domain.DKIMEd25519Selector, domain.DKIMEd25519PublicKey)
+	}
 	
+	// Tracking host CNAME
+	if domain.TrackingHost != "" {
+		records["TRACKING"] = s.TrackingDNSRecord(domain.TrackingHost)
+	}
+
 	// DMARC record
 	dmarcDomain := fmt.Sprintf("_dmarc.%s", domain.Domain)
 	records["DMARC"] = fmt.Sprintf("%s: %s", dmarcDomain, domain.DMARCRecord)
@@ -332,3 +439,19 @@ func (s *Service) GetRequiredDNSRecords(domain *store.Domain) map[string]string
 	
 	return records
 }
+
+// dkimDNSRecord formats the TXT record to publish for a DKIM selector
+func dkimDNSRecord(domain, selector, publicKey string) string {
+	dkimDomain := fmt.Sprintf("%s._domainkey.%s", selector, domain)
+	record, err := mail.DKIMRecord(publicKey)
+	if err != nil {
+		logrus.Errorf("Invalid DKIM public key for %s: %v", dkimDomain, err)
+		record = publicKey
+	}
+	return fmt.Sprintf("%s: %s", dkimDomain, record)
+}
+
+// TrackingDNSRecord formats the CNAME record to publish for a tracking host
+func (s *Service) TrackingDNSRecord(host string) string {
+	return fmt.Sprintf("%s: CNAME %s", host, s.TrackingTarget)
+}
@@ -1,10 +1,16 @@
 package http
 
 import (
+	"database/sql"
 	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
+	"net"
 	"net/http"
+	netmail "net/mail"
 	"regexp"
 	"strconv"
 	"strings"
@@ -14,6 +20,7 @@ import (
 	"newsletter/internal/mail"
 	"newsletter/internal/deliverability"
 	"newsletter/internal/jobs"
+	"newsletter/internal/tracking"
 
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
@@ -24,7 +31,13 @@ type Services struct {
 	Queue          *jobs.Queue
 	Mail           *mail.Service
 	Deliverability *deliverability.Service
+	DKIMRotator    *jobs.DKIMRotator
+	Tracking       *tracking.Signer
+	Events         *tracking.Recorder
 	LicenseKey     string
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For is
+	// believed; without any the header is ignored
+	TrustedProxies []*net.IPNet
 }
 
 type APIResponse struct {
@@ -51,6 +64,11 @@ func NewRouter(services *Services) *mux.Router {
 	api.HandleFunc("/domains/{id}", getDomainHandler(services)).Methods("GET")
 	api.HandleFunc("/domains/{id}/status", getDomainStatusHandler(services)).Methods("GET")
 	api.HandleFunc("/domains/{id}/dkim/rotate", rotateDKIMHandler(services)).Methods("POST")
+	api.HandleFunc("/domains/{id}/dkim/keys", getDomainKeysHandler(services)).Methods("GET")
+	api.HandleFunc("/domains/{id}/warmup", getDomainWarmupHandler(services)).Methods("GET")
+	api.HandleFunc("/domains/{id}/warmup", setDomainWarmupHandler(services)).Methods("PUT")
+	api.HandleFunc("/domains/{id}/warmup", deleteDomainWarmupHandler(services)).Methods("DELETE")
+	api.HandleFunc("/domains/{id}/tracking-host", setTrackingHostHandler(services)).Methods("PUT")
 	
 	// List routes
 	api.HandleFunc("/lists", createListHandler(services)).Methods("POST")
@@ -66,16 +84,35 @@ func NewRouter(services *Services) *mux.Router {
 	api.HandleFunc("/campaigns/{id}/test", testCampaignHandler(services)).Methods("POST")
 	api.HandleFunc("/campaigns/{id}/schedule", scheduleCampaignHandler(services)).Methods("POST")
 	api.HandleFunc("/campaigns/{id}/report", getCampaignReportHandler(services)).Methods("GET")
+	api.HandleFunc("/campaigns/{id}/recipients", getCampaignRecipientsHandler(services)).Methods("GET")
 	
-	// Tracking routes
-	api.HandleFunc("/track/click", trackClickHandler(services)).Methods("POST")
-	api.HandleFunc("/track/open", trackOpenHandler(services)).Methods("POST")
-	
+	// Click-tracking redirect and open pixel of campaign mail
+	r.HandleFunc("/l/{token}", clickRedirectHandler(services)).Methods("GET")
+	r.HandleFunc("/o/{token}", openPixelHandler(services)).Methods("GET")
+
 	// Unsubscribe route
-	r.HandleFunc("/u/{subscriberId}/{token}", unsubscribeHandler(services)).Methods("GET")
+	r.HandleFunc("/u/{subscriberId}/{token}", unsubscribeHandler(services)).Methods("GET", "POST")
 	
-	// Bounce webhook
+	// Bounce and mailto: unsubscribe webhooks
 	api.HandleFunc("/hooks/bounce", bounceHandler(services)).Methods("POST")
+	api.HandleFunc("/hooks/unsubscribe", unsubscribeHookHandler(services)).Methods("POST")
+
+	// Mail transport stats
+	api.HandleFunc("/mail/stats", getMailStatsHandler(services)).Methods("GET")
+
+	// Job routes (dead-letter queue inspection and replay)
+	api.HandleFunc("/jobs", getJobsHandler(services)).Methods("GET")
+	api.HandleFunc("/jobs/dead-letter", getDeadLetterJobsHandler(services)).Methods("GET")
+	api.HandleFunc("/jobs/{id}", getJobHandler(services)).Methods("GET")
+	api.HandleFunc("/jobs/{id}/retry", retryJobHandler(services)).Methods("POST")
+	api.HandleFunc("/jobs/{id}/discard", discardJobHandler(services)).Methods("POST")
+
+	// Recurring schedule routes
+	api.HandleFunc("/schedules", getSchedulesHandler(services)).Methods("GET")
+	api.HandleFunc("/schedules", createScheduleHandler(services)).Methods("POST")
+	api.HandleFunc("/schedules/{id}", getScheduleHandler(services)).Methods("GET")
+	api.HandleFunc("/schedules/{id}", updateScheduleHandler(services)).Methods("PUT")
+	api.HandleFunc("/schedules/{id}", deleteScheduleHandler(services)).Methods("DELETE")
 
 	return r
 }
@@ -111,30 +148,55 @@ func createDomainHandler(services *Services) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req struct {
 			Domain string `json:"domain"`
+			// New domains warm up on WarmupSchedule, or the default
+			// schedule, unless Warmup is false
+			Warmup         *bool `json:"warmup"`
+			WarmupSchedule []int `json:"warmup_schedule"`
+			// Optional host for the domain's tracking and unsubscribe links
+			TrackingHost string `json:"tracking_host"`
 		}
 		
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			respondJSON(w, APIResponse{Success: false, Error: "Invalid request"}, http.StatusBadRequest)
 			return
 		}
+		if err := validateWarmupSchedule(req.WarmupSchedule); err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: err.Error()}, http.StatusBadRequest)
+			return
+		}
+		req.TrackingHost = strings.ToLower(strings.TrimSpace(req.TrackingHost))
+		if err := validateTrackingHost(req.TrackingHost, req.Domain); err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: err.Error()}, http.StatusBadRequest)
+			return
+		}
 
-		// Generate DKIM keys
+		// Generate DKIM keys: RSA for every receiver, plus Ed25519 for
+		// those that support RFC 8463
 		selector := "newsletter"
 		privateKey, publicKey, err := mail.GenerateDKIMKeys()
 		if err != nil {
 			respondJSON(w, APIResponse{Success: false, Error: "Failed to generate DKIM keys"}, http.StatusInternalServerError)
 			return
 		}
+		edPrivateKey, edPublicKey, err := mail.GenerateEd25519DKIMKeys()
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Failed to generate DKIM keys"}, http.StatusInternalServerError)
+			return
+		}
 
 		// Create domain record
 		domain := &store.Domain{
-			Domain:          req.Domain,
-			DKIMSelector:    selector,
-			DKIMPrivateKey:  privateKey,
-			DKIMPublicKey:   publicKey,
-			SPFRecord:       fmt.Sprintf("v=spf1 a mx ip4:%s ~all", r.RemoteAddr), // TODO: Get actual server IP
-			DMARCRecord:     fmt.Sprintf("v=DMARC1; p=quarantine; rua=mailto:dmarc@%s", req.Domain),
-			PTRRecord:       fmt.Sprintf("mail.%s", req.Domain),
+			Domain:                req.Domain,
+			DKIMSelector:          selector,
+			DKIMPrivateKey:        privateKey,
+			DKIMPublicKey:         publicKey,
+			DKIMEd25519Selector:   selector + "-ed25519",
+			DKIMEd25519PrivateKey: edPrivateKey,
+			DKIMEd25519PublicKey:  edPublicKey,
+			SPFRecord:             fmt.Sprintf("v=spf1 a mx ip4:%s ~all", r.RemoteAddr), // TODO: Get actual server IP
+			DMARCRecord:           fmt.Sprintf("v=DMARC1; p=quarantine; rua=mailto:dmarc@%s", req.Domain),
+			PTRRecord:             fmt.Sprintf("mail.%s", req.Domain),
+			TrackingHost:          req.TrackingHost,
 		}
 
 		if err := services.DB.CreateDomain(domain); err != nil {
@@ -142,6 +204,18 @@ func createDomainHandler(services *Services) http.HandlerFunc {
 			return
 		}
 
+		// A new domain sending at full volume gets blocked, so it starts
+		// on a warm-up plan
+		if req.Warmup == nil || *req.Warmup {
+			schedule := req.WarmupSchedule
+			if len(schedule) == 0 {
+				schedule = jobs.DefaultWarmupSchedule
+			}
+			if _, err := services.DB.SetDomainWarmup(domain.ID, schedule); err != nil {
+				logrus.Errorf("Failed to create warm-up plan for %s: %v", domain.Domain, err)
+			}
+		}
+
 		respondJSON(w, APIResponse{Success: true, Data: domain})
 	}
 }
@@ -218,22 +292,236 @@ func rotateDKIMHandler(services *Services) http.HandlerFunc {
 			return
 		}
 
-		// Generate new DKIM keys
-		selector := "newsletter"
-		privateKey, publicKey, err := mail.GenerateDKIMKeys()
+		// The body is optional and defaults to rotating the RSA key
+		var req struct {
+			Algorithm string `json:"algorithm"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			respondJSON(w, APIResponse{Success: false, Error: "Invalid request body"}, http.StatusBadRequest)
+			return
+		}
+		if req.Algorithm == "" {
+			req.Algorithm = "rsa"
+		}
+		if req.Algorithm != "rsa" && req.Algorithm != "ed25519" {
+			respondJSON(w, APIResponse{Success: false, Error: "Algorithm must be rsa or ed25519"}, http.StatusBadRequest)
+			return
+		}
+
+		// The new key only signs once the rotation job sees its record in DNS
+		key, record, err := services.DKIMRotator.StartRotation(domain, req.Algorithm)
+		if errors.Is(err, jobs.ErrRotationPending) {
+			respondJSON(w, APIResponse{Success: false, Error: err.Error()}, http.StatusConflict)
+			return
+		}
 		if err != nil {
-			respondJSON(w, APIResponse{Success: false, Error: "Failed to generate DKIM keys"}, http.StatusInternalServerError)
+			logrus.Errorf("Failed to start DKIM rotation for %s: %v", domain.Domain, err)
+			respondJSON(w, APIResponse{Success: false, Error: "Failed to start DKIM rotation"}, http.StatusInternalServerError)
 			return
 		}
 
-		// Update domain with new keys
-		domain.DKIMSelector = selector
-		domain.DKIMPrivateKey = privateKey
-		domain.DKIMPublicKey = publicKey
+		respondJSON(w, APIResponse{Success: true, Data: map[string]interface{}{
+			"key": key,
+			"dns_record": map[string]string{
+				"type":  "TXT",
+				"name":  fmt.Sprintf("%s._domainkey.%s", key.Selector, domain.Domain),
+				"value": record,
+			},
+		}}, http.StatusAccepted)
+	}
+}
+
+func getDomainWarmupHandler(services *Services) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Invalid domain ID"}, http.StatusBadRequest)
+			return
+		}
 
-		// TODO: Update domain in database
+		status, err := services.Queue.WarmupStatus(id)
+		if err == sql.ErrNoRows {
+			respondJSON(w, APIResponse{Success: false, Error: "Domain has no warm-up plan"}, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Failed to get warm-up status"}, http.StatusInternalServerError)
+			return
+		}
 
-		respondJSON(w, APIResponse{Success: true, Data: domain})
+		respondJSON(w, APIResponse{Success: true, Data: status})
+	}
+}
+
+// setDomainWarmupHandler starts a new warm-up plan for a domain today, e.g.
+// after a sending IP change. The schedule defaults to the built-in ramp.
+func setDomainWarmupHandler(services *Services) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Invalid domain ID"}, http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			Schedule []int `json:"schedule"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			respondJSON(w, APIResponse{Success: false, Error: "Invalid request body"}, http.StatusBadRequest)
+			return
+		}
+		if err := validateWarmupSchedule(req.Schedule); err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: err.Error()}, http.StatusBadRequest)
+			return
+		}
+		if len(req.Schedule) == 0 {
+			req.Schedule = jobs.DefaultWarmupSchedule
+		}
+
+		if _, err := services.DB.GetDomain(id); err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Domain not found"}, http.StatusNotFound)
+			return
+		}
+		if _, err := services.DB.SetDomainWarmup(id, req.Schedule); err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Failed to set warm-up plan"}, http.StatusInternalServerError)
+			return
+		}
+
+		status, err := services.Queue.WarmupStatus(id)
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Failed to get warm-up status"}, http.StatusInternalServerError)
+			return
+		}
+		respondJSON(w, APIResponse{Success: true, Data: status})
+	}
+}
+
+// deleteDomainWarmupHandler ends a domain's warm-up, lifting its daily limit.
+func deleteDomainWarmupHandler(services *Services) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Invalid domain ID"}, http.StatusBadRequest)
+			return
+		}
+
+		if err := services.DB.DeleteDomainWarmup(id); err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Failed to delete warm-up plan"}, http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, APIResponse{Success: true})
+	}
+}
+
+// setTrackingHostHandler sets the host that links in a domain's mail point
+// to; an empty host goes back to the public base URL. The response carries
+// the CNAME record the host needs.
+func setTrackingHostHandler(services *Services) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Invalid domain ID"}, http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			TrackingHost string `json:"tracking_host"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Invalid request body"}, http.StatusBadRequest)
+			return
+		}
+
+		domain, err := services.DB.GetDomain(id)
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Domain not found"}, http.StatusNotFound)
+			return
+		}
+		host := strings.ToLower(strings.TrimSpace(req.TrackingHost))
+		if err := validateTrackingHost(host, domain.Domain); err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: err.Error()}, http.StatusBadRequest)
+			return
+		}
+
+		if err := services.DB.SetDomainTrackingHost(id, host); err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Failed to set tracking host"}, http.StatusInternalServerError)
+			return
+		}
+		domain.TrackingHost = host
+
+		data := map[string]interface{}{"domain": domain}
+		if host != "" {
+			data["dns_record"] = map[string]string{
+				"type":  "CNAME",
+				"name":  host,
+				"value": services.Deliverability.TrackingTarget,
+			}
+		}
+		respondJSON(w, APIResponse{Success: true, Data: data})
+	}
+}
+
+// hostnamePattern matches a lower-case DNS hostname
+var hostnamePattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// validateTrackingHost checks that host, if set, is a hostname under
+// domain, so that links align with the sending domain.
+func validateTrackingHost(host, domain string) error {
+	if host == "" {
+		return nil
+	}
+	if !hostnamePattern.MatchString(host) {
+		return fmt.Errorf("tracking host %q is not a valid hostname", host)
+	}
+	if !strings.HasSuffix(host, "."+strings.ToLower(domain)) {
+		return fmt.Errorf("tracking host must be a subdomain of %s", domain)
+	}
+	return nil
+}
+
+func validateWarmupSchedule(schedule []int) error {
+	for i, limit := range schedule {
+		if limit <= 0 {
+			return fmt.Errorf("warm-up day %d must allow at least one message", i+1)
+		}
+	}
+	return nil
+}
+
+func getDomainKeysHandler(services *Services) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Invalid domain ID"}, http.StatusBadRequest)
+			return
+		}
+
+		if _, err := services.DB.GetDomain(id); err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Domain not found"}, http.StatusNotFound)
+			return
+		}
+
+		keys, err := services.DB.GetDomainKeys(id)
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Failed to get domain keys"}, http.StatusInternalServerError)
+			return
+		}
+		history, err := services.DB.GetDomainKeyHistory(id)
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Failed to get domain key history"}, http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, APIResponse{Success: true, Data: map[string]interface{}{
+			"keys":    keys,
+			"history": history,
+		}})
 	}
 }
 
@@ -386,10 +674,10 @@ func importSubscribersHandler(services *Services) http.HandlerFunc {
 			attributesJSON, _ := json.Marshal(attributes)
 
 			// Create or update subscriber
-			_, err := services.DB.GetSubscriberByEmail(email)
+			subscriber, err := services.DB.GetSubscriberByEmail(email)
 			if err != nil {
 				// Create new subscriber
-				_, err = services.DB.CreateSubscriber(email, attributesJSON)
+				subscriber, err = services.DB.CreateSubscriber(email, attributesJSON)
 				if err != nil {
 					errors = append(errors, fmt.Sprintf("Row %d: failed to create subscriber: %v", i+2, err))
 					skipped++
@@ -397,8 +685,12 @@ func importSubscribersHandler(services *Services) http.HandlerFunc {
 				}
 			}
 
-			// Add to list (this would need to be implemented in the store)
-			// For now, we'll just count as imported
+			// Add to list
+			if err := services.DB.AddListMember(listID, subscriber.ID); err != nil {
+				errors = append(errors, fmt.Sprintf("Row %d: failed to add subscriber to list: %v", i+2, err))
+				skipped++
+				continue
+			}
 			imported++
 		}
 
@@ -532,6 +824,9 @@ func testCampaignHandler(services *Services) http.HandlerFunc {
 			}
 		}
 
+		// A From domain that is not configured sends unsigned
+		domain, _ := services.DB.GetDomainByName(campaign.FromEmail[strings.LastIndex(campaign.FromEmail, "@")+1:])
+
 		// Send test emails
 		results := make([]map[string]interface{}, 0, len(req.TestEmails))
 		
@@ -543,11 +838,11 @@ func testCampaignHandler(services *Services) http.HandlerFunc {
 				Status: "active",
 			}
 
-			// Create test message
-			message := services.Mail.CreateCampaignMessage(campaign, testSubscriber)
+			// Create test message, signed and linked like the real send
+			message := services.Mail.CreateCampaignMessage(campaign, testSubscriber, domain)
 			
 			// Send email
-			err := services.Mail.Send(message)
+			response, err := services.Mail.Send(r.Context(), message)
 			
 			result := map[string]interface{}{
 				"email": email,
@@ -556,6 +851,8 @@ func testCampaignHandler(services *Services) http.HandlerFunc {
 			
 			if err != nil {
 				result["error"] = err.Error()
+			} else {
+				result["smtp_response"] = response
 			}
 			
 			results = append(results, result)
@@ -595,80 +892,75 @@ func scheduleCampaignHandler(services *Services) http.HandlerFunc {
 			return
 		}
 
-		// Validate campaign status
+		// A client retrying after a timeout gets the plan job it already
+		// started back
 		if campaign.Status != "draft" {
+			job, err := services.DB.GetLiveJobByKey(jobs.CampaignSendKey(id))
+			if err == nil {
+				respondCampaignStarted(w, campaign.Status, job)
+				return
+			}
+			if err != sql.ErrNoRows {
+				respondJSON(w, APIResponse{Success: false, Error: "Failed to get campaign job"}, http.StatusInternalServerError)
+				return
+			}
 			respondJSON(w, APIResponse{Success: false, Error: "Campaign must be in draft status to schedule"}, http.StatusBadRequest)
 			return
 		}
 
-		// If no scheduled time provided, send immediately
-		if req.ScheduledAt == nil {
-			req.ScheduledAt = &time.Time{}
-			*req.ScheduledAt = time.Now()
-		}
-
-		// Validate scheduled time
-		if req.ScheduledAt.Before(time.Now()) {
+		// Validate scheduled time; without one the campaign is sent immediately
+		if req.ScheduledAt != nil && req.ScheduledAt.Before(time.Now()) {
 			respondJSON(w, APIResponse{Success: false, Error: "Scheduled time cannot be in the past"}, http.StatusBadRequest)
 			return
 		}
 
-		// Update campaign status
-		if req.ScheduledAt.After(time.Now()) {
-			// Schedule for later
-			err = services.DB.UpdateCampaignStatus(id, "scheduled")
-			if err != nil {
-				respondJSON(w, APIResponse{Success: false, Error: "Failed to schedule campaign"}, http.StatusInternalServerError)
-				return
-			}
-
-			// Enqueue campaign job
-			payload := jobs.SendBatchPayload{
-				CampaignID: id,
-				Recipients: []string{}, // Will be populated by the job handler
-			}
-			
-			err = services.Queue.Enqueue("send_batch", payload, *req.ScheduledAt)
-			if err != nil {
-				respondJSON(w, APIResponse{Success: false, Error: "Failed to enqueue campaign"}, http.StatusInternalServerError)
+		// The status changes together with the enqueue of the planner,
+		// which expands the list into send batches
+		status, runAt := "sending", time.Now()
+		if req.ScheduledAt != nil {
+			status, runAt = "scheduled", *req.ScheduledAt
+		}
+		job, err := services.Queue.StartCampaign(id, status, runAt)
+		if err != nil {
+			logrus.Errorf("Failed to start campaign %d: %v", id, err)
+			respondJSON(w, APIResponse{Success: false, Error: "Failed to enqueue campaign"}, http.StatusInternalServerError)
+			return
+		}
+		if job == nil {
+			// Another request started it in the meantime
+			if job, err = services.DB.GetLiveJobByKey(jobs.CampaignSendKey(id)); err != nil {
+				respondJSON(w, APIResponse{Success: false, Error: "Campaign must be in draft status to schedule"}, http.StatusBadRequest)
 				return
 			}
-
-			respondJSON(w, APIResponse{
-				Success: true,
-				Data: map[string]interface{}{
-					"message":      "Campaign scheduled successfully",
-					"scheduled_at": req.ScheduledAt,
-				},
-			})
-		} else {
-			// Send immediately
-			err = services.DB.UpdateCampaignStatus(id, "sending")
-			if err != nil {
-				respondJSON(w, APIResponse{Success: false, Error: "Failed to start campaign"}, http.StatusInternalServerError)
-				return
+			if campaign, err = services.DB.GetCampaign(id); err == nil {
+				status = campaign.Status
 			}
+		}
 
-			// Enqueue campaign job for immediate execution
-			payload := jobs.SendBatchPayload{
-				CampaignID: id,
-				Recipients: []string{}, // Will be populated by the job handler
-			}
-			
-			err = services.Queue.Enqueue("send_batch", payload, time.Now())
-			if err != nil {
-				respondJSON(w, APIResponse{Success: false, Error: "Failed to enqueue campaign"}, http.StatusInternalServerError)
-				return
-			}
+		respondCampaignStarted(w, status, job)
+	}
+}
 
-			respondJSON(w, APIResponse{
-				Success: true,
-				Data: map[string]interface{}{
-					"message": "Campaign started successfully",
-				},
-			})
-		}
+func respondCampaignStarted(w http.ResponseWriter, status string, job *store.Job) {
+	if status == "scheduled" {
+		respondJSON(w, APIResponse{
+			Success: true,
+			Data: map[string]interface{}{
+				"message":      "Campaign scheduled successfully",
+				"scheduled_at": job.RunAt,
+				"job_id":       job.ID,
+			},
+		})
+		return
 	}
+
+	respondJSON(w, APIResponse{
+		Success: true,
+		Data: map[string]interface{}{
+			"message": "Campaign started successfully",
+			"job_id":  job.ID,
+		},
+	})
 }
 
 func getCampaignReportHandler(services *Services) http.HandlerFunc {
@@ -690,73 +982,295 @@ func getCampaignReportHandler(services *Services) http.HandlerFunc {
 	}
 }
 
-func trackClickHandler(services *Services) http.HandlerFunc {
+// getCampaignRecipientsHandler returns the campaign's delivery ledger,
+// optionally filtered by status or email, with per-status totals.
+func getCampaignRecipientsHandler(services *Services) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var req struct {
-			CampaignID   int    `json:"campaign_id"`
-			SubscriberID int    `json:"subscriber_id"`
-			URL          string `json:"url"`
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Invalid campaign ID"}, http.StatusBadRequest)
+			return
 		}
-		
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			respondJSON(w, APIResponse{Success: false, Error: "Invalid request"}, http.StatusBadRequest)
+
+		if _, err := services.DB.GetCampaign(id); err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Campaign not found"}, http.StatusNotFound)
 			return
 		}
 
-		meta, _ := json.Marshal(map[string]string{"url": req.URL})
-		if err := services.DB.RecordEvent(req.CampaignID, req.SubscriberID, "click", meta); err != nil {
-			logrus.Errorf("Failed to record click event: %v", err)
+		query := r.URL.Query()
+		filter := store.RecipientFilter{Status: query.Get("status"), Email: query.Get("email")}
+		filter.Limit, _ = strconv.Atoi(query.Get("limit"))
+		filter.Offset, _ = strconv.Atoi(query.Get("offset"))
+
+		recipients, err := services.DB.GetCampaignRecipients(id, filter)
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Failed to get campaign recipients"}, http.StatusInternalServerError)
+			return
 		}
 
-		respondJSON(w, APIResponse{Success: true})
+		counts, err := services.DB.CountCampaignRecipients(id)
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Failed to count campaign recipients"}, http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, APIResponse{
+			Success: true,
+			Data: map[string]interface{}{
+				"counts":     counts,
+				"recipients": recipients,
+			},
+		})
 	}
 }
 
-func trackOpenHandler(services *Services) http.HandlerFunc {
+// clickRedirectHandler records a click on a rewritten link and redirects to
+// its original URL. The URL comes from the signed token only, so the
+// endpoint cannot be used to redirect anywhere else.
+func clickRedirectHandler(services *Services) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var req struct {
-			CampaignID   int `json:"campaign_id"`
-			SubscriberID int `json:"subscriber_id"`
-		}
-		
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			respondJSON(w, APIResponse{Success: false, Error: "Invalid request"}, http.StatusBadRequest)
+		click, err := services.Tracking.ParseClickToken(mux.Vars(r)["token"])
+		if err != nil {
+			http.Error(w, "Invalid link", http.StatusNotFound)
 			return
 		}
 
-		if err := services.DB.RecordEvent(req.CampaignID, req.SubscriberID, "open", nil); err != nil {
-			logrus.Errorf("Failed to record open event: %v", err)
+		meta, _ := json.Marshal(map[string]interface{}{
+			"url":        click.URL,
+			"link_index": click.Index,
+			"user_agent": r.UserAgent(),
+			"ip":         clientIP(r, services.TrustedProxies),
+		})
+		services.Events.Record(click.CampaignID, click.SubscriberID, "click", meta)
+
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, click.URL, http.StatusFound)
+	}
+}
+
+// transparentGIF is a 1x1 transparent GIF
+var transparentGIF = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// openPixelHandler serves the open-tracking pixel and records the open in
+// the background. Mail clients get the image even for an invalid token,
+// which is simply not recorded.
+func openPixelHandler(services *Services) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if open, err := services.Tracking.ParseOpenToken(mux.Vars(r)["token"]); err == nil {
+			meta, _ := json.Marshal(map[string]string{
+				"user_agent": r.UserAgent(),
+				"ip":         clientIP(r, services.TrustedProxies),
+			})
+			services.Events.Record(open.CampaignID, open.SubscriberID, "open", meta)
 		}
 
-		respondJSON(w, APIResponse{Success: true})
+		// Every open has to reach us, not a cache
+		w.Header().Set("Content-Type", "image/gif")
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate, private, max-age=0")
+		w.Header().Set("Pragma", "no-cache")
+		w.Header().Set("Expires", "0")
+		w.Write(transparentGIF)
+	}
+}
+
+// clientIP returns the address of the client. X-Forwarded-For is only
+// believed when the request comes from a trusted proxy, and then only up to
+// the first hop that is not one, as anything before it is client-supplied.
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+	if !isTrustedProxy(ip, trusted) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop, trusted) {
+			break
+		}
+	}
+	return ip
+}
+
+func isTrustedProxy(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range trusted {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// unsubscribePage is the page behind unsubscribe links. GET only asks for
+// confirmation, as link scanners follow links in mail; the unsubscribe
+// itself is a POST, from the page's button or from a mailbox provider's
+// one-click unsubscribe (RFC 8058).
+var unsubscribePage = template.Must(template.New("unsubscribe").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Unsubscribe</title>
+<style>body{font-family:sans-serif;max-width:32em;margin:4em auto;padding:0 1em;color:#222}button{font-size:1em;padding:.5em 1.5em}</style>
+</head>
+<body>
+{{if .Invalid}}
+<h1>Invalid link</h1>
+<p>This unsubscribe link is not valid. Please use the link from the most recent email you received.</p>
+{{else if .Unsubscribed}}
+<h1>You are unsubscribed</h1>
+<p>{{.Email}} will no longer receive emails from us.</p>
+{{else}}
+<h1>Unsubscribe</h1>
+<p>Do you want to stop receiving emails at {{.Email}}?</p>
+<form method="post">
+<input type="hidden" name="confirm" value="1">
+<button type="submit">Unsubscribe</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+type unsubscribePageData struct {
+	Email        string
+	Unsubscribed bool
+	Invalid      bool
+}
+
+func renderUnsubscribePage(w http.ResponseWriter, data unsubscribePageData, status int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := unsubscribePage.Execute(w, data); err != nil {
+		logrus.Errorf("Failed to render unsubscribe page: %v", err)
 	}
 }
 
+// unsubscribeHandler serves signed unsubscribe links: GET shows the
+// confirmation page and POST unsubscribes, recording an unsubscribe event
+// for the campaign the link was sent in.
 func unsubscribeHandler(services *Services) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		subscriberID, err := strconv.Atoi(vars["subscriberId"])
 		if err != nil {
-			respondJSON(w, APIResponse{Success: false, Error: "Invalid subscriber ID"}, http.StatusBadRequest)
+			renderUnsubscribePage(w, unsubscribePageData{Invalid: true}, http.StatusNotFound)
 			return
 		}
 
-		// TODO: Implement proper token validation
-		_ = vars["token"]
-
-		// Update subscriber status
-		if err := services.DB.UpdateSubscriberStatus(subscriberID, "unsubscribed"); err != nil {
-			respondJSON(w, APIResponse{Success: false, Error: "Failed to unsubscribe"}, http.StatusInternalServerError)
+		// The subscriber ID in the path must be the one the token was
+		// issued for
+		unsub, err := services.Tracking.ParseUnsubscribeToken(vars["token"])
+		if err != nil || unsub.SubscriberID != subscriberID {
+			renderUnsubscribePage(w, unsubscribePageData{Invalid: true}, http.StatusNotFound)
 			return
 		}
 
-		// Add to suppressions
 		subscriber, err := services.DB.GetSubscriber(subscriberID)
-		if err == nil {
-			services.DB.AddSuppression(subscriber.Email, "unsubscribed")
+		if err == sql.ErrNoRows {
+			renderUnsubscribePage(w, unsubscribePageData{Invalid: true}, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logrus.Errorf("Failed to get subscriber %d: %v", subscriberID, err)
+			http.Error(w, "Failed to unsubscribe", http.StatusInternalServerError)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			renderUnsubscribePage(w, unsubscribePageData{
+				Email:        subscriber.Email,
+				Unsubscribed: subscriber.Status == "unsubscribed",
+			}, http.StatusOK)
+			return
 		}
 
-		respondJSON(w, APIResponse{Success: true, Data: map[string]string{"message": "Successfully unsubscribed"}})
+		// Mailbox providers post List-Unsubscribe=One-Click; anything else
+		// came from the confirmation page
+		method := "page"
+		if r.PostFormValue("List-Unsubscribe") == "One-Click" {
+			method = "one-click"
+		}
+		meta, _ := json.Marshal(map[string]string{
+			"method":     method,
+			"user_agent": r.UserAgent(),
+			"ip":         clientIP(r, services.TrustedProxies),
+		})
+		if _, err := services.DB.Unsubscribe(subscriberID, unsub.CampaignID, meta); err != nil {
+			logrus.Errorf("Failed to unsubscribe subscriber %d: %v", subscriberID, err)
+			http.Error(w, "Failed to unsubscribe", http.StatusInternalServerError)
+			return
+		}
+
+		renderUnsubscribePage(w, unsubscribePageData{Email: subscriber.Email, Unsubscribed: true}, http.StatusOK)
+	}
+}
+
+// unsubscribeHookHandler honors mail to the List-Unsubscribe mailto:
+// address. The MTA posts the envelope recipient, which carries the
+// subscriber's signed token, and sender of each message it receives there.
+func unsubscribeHookHandler(services *Services) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			To   string `json:"to"`
+			From string `json:"from"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Invalid request"}, http.StatusBadRequest)
+			return
+		}
+
+		to := req.To
+		if addr, err := netmail.ParseAddress(req.To); err == nil {
+			to = addr.Address
+		}
+		token := services.Mail.UnsubscribeTokenFromAddress(to)
+		if token == "" {
+			respondJSON(w, APIResponse{Success: false, Error: "Not an unsubscribe address"}, http.StatusBadRequest)
+			return
+		}
+		unsub, err := services.Tracking.ParseUnsubscribeAddressToken(token)
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Invalid unsubscribe token"}, http.StatusBadRequest)
+			return
+		}
+
+		meta, _ := json.Marshal(map[string]string{
+			"method": "mailto",
+			"from":   req.From,
+		})
+		unsubscribed, err := services.DB.Unsubscribe(unsub.SubscriberID, unsub.CampaignID, meta)
+		if err == sql.ErrNoRows {
+			respondJSON(w, APIResponse{Success: false, Error: "Subscriber not found"}, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logrus.Errorf("Failed to unsubscribe subscriber %d: %v", unsub.SubscriberID, err)
+			respondJSON(w, APIResponse{Success: false, Error: "Failed to unsubscribe"}, http.StatusInternalServerError)
+			return
+		}
+
+		if unsubscribed {
+			logrus.Infof("Subscriber %d unsubscribed by mail from %s", unsub.SubscriberID, req.From)
+		}
+		respondJSON(w, APIResponse{Success: true, Data: map[string]string{"message": "Unsubscribed"}})
 	}
 }
 
@@ -800,7 +1314,7 @@ func bounceHandler(services *Services) http.HandlerFunc {
 			BounceType: bounceData.BounceType,
 		}
 
-		err := services.Queue.Enqueue("process_bounce", payload, time.Now())
+		_, err := services.Queue.Enqueue("process_bounce", payload, time.Now())
 		if err != nil {
 			logrus.Errorf("Failed to enqueue bounce processing: %v", err)
 			respondJSON(w, APIResponse{Success: false, Error: "Failed to process bounce"}, http.StatusInternalServerError)
@@ -822,6 +1336,339 @@ func bounceHandler(services *Services) http.HandlerFunc {
 	}
 }
 
+func getMailStatsHandler(services *Services) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, ok := services.Mail.TransportStats()
+		if !ok {
+			respondJSON(w, APIResponse{Success: false, Error: "Mail transport does not pool connections"}, http.StatusNotFound)
+			return
+		}
+
+		respondJSON(w, APIResponse{Success: true, Data: stats})
+	}
+}
+
+func getJobsHandler(services *Services) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter := jobFilterFromQuery(r)
+		filter.Status = r.URL.Query().Get("status")
+
+		jobList, err := services.DB.ListJobs(filter)
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Failed to get jobs"}, http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, APIResponse{Success: true, Data: jobList})
+	}
+}
+
+func getDeadLetterJobsHandler(services *Services) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter := jobFilterFromQuery(r)
+		filter.Status = "failed"
+
+		jobList, err := services.DB.ListJobs(filter)
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Failed to get dead-letter jobs"}, http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, APIResponse{Success: true, Data: jobList})
+	}
+}
+
+func getJobHandler(services *Services) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Invalid job ID"}, http.StatusBadRequest)
+			return
+		}
+
+		job, err := services.DB.GetJob(id)
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Job not found"}, http.StatusNotFound)
+			return
+		}
+
+		jobErrors, err := services.DB.GetJobErrors(id)
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Failed to get job errors"}, http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, APIResponse{
+			Success: true,
+			Data: map[string]interface{}{
+				"job":    job,
+				"errors": jobErrors,
+			},
+		})
+	}
+}
+
+func retryJobHandler(services *Services) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Invalid job ID"}, http.StatusBadRequest)
+			return
+		}
+
+		job, err := services.DB.GetJob(id)
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Job not found"}, http.StatusNotFound)
+			return
+		}
+
+		if err := services.Queue.Retry(job); err != nil {
+			if err == store.ErrJobNotFailed {
+				respondJSON(w, APIResponse{Success: false, Error: "Only failed jobs can be retried"}, http.StatusConflict)
+				return
+			}
+			if err == store.ErrJobDuplicate {
+				respondJSON(w, APIResponse{Success: false, Error: err.Error()}, http.StatusConflict)
+				return
+			}
+			respondJSON(w, APIResponse{Success: false, Error: "Failed to retry job"}, http.StatusInternalServerError)
+			return
+		}
+
+		logrus.Infof("Job %d re-queued from dead-letter queue", id)
+		respondJSON(w, APIResponse{Success: true, Data: map[string]string{"message": "Job re-queued"}})
+	}
+}
+
+func discardJobHandler(services *Services) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Invalid job ID"}, http.StatusBadRequest)
+			return
+		}
+
+		if _, err := services.DB.GetJob(id); err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Job not found"}, http.StatusNotFound)
+			return
+		}
+
+		if err := services.DB.DiscardJob(id); err != nil {
+			if err == store.ErrJobNotFailed {
+				respondJSON(w, APIResponse{Success: false, Error: "Only failed jobs can be discarded"}, http.StatusConflict)
+				return
+			}
+			respondJSON(w, APIResponse{Success: false, Error: "Failed to discard job"}, http.StatusInternalServerError)
+			return
+		}
+
+		logrus.Infof("Job %d discarded from dead-letter queue", id)
+		respondJSON(w, APIResponse{Success: true, Data: map[string]string{"message": "Job discarded"}})
+	}
+}
+
+func getSchedulesHandler(services *Services) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		schedules, err := services.DB.GetSchedules()
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Failed to get schedules"}, http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, APIResponse{Success: true, Data: schedules})
+	}
+}
+
+func createScheduleHandler(services *Services) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Name     string          `json:"name"`
+			CronExpr string          `json:"cron_expr"`
+			JobType  string          `json:"job_type"`
+			Payload  json.RawMessage `json:"payload"`
+			Enabled  *bool           `json:"enabled"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Invalid request"}, http.StatusBadRequest)
+			return
+		}
+
+		if req.Name == "" {
+			respondJSON(w, APIResponse{Success: false, Error: "Name is required"}, http.StatusBadRequest)
+			return
+		}
+		if !services.Queue.Registered(req.JobType) {
+			respondJSON(w, APIResponse{Success: false, Error: fmt.Sprintf("Unknown job type: %s", req.JobType)}, http.StatusBadRequest)
+			return
+		}
+
+		cron, err := jobs.ParseCron(req.CronExpr)
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: fmt.Sprintf("Invalid cron expression: %v", err)}, http.StatusBadRequest)
+			return
+		}
+		nextRunAt := cron.Next(time.Now())
+		if nextRunAt.IsZero() {
+			respondJSON(w, APIResponse{Success: false, Error: "Cron expression never fires"}, http.StatusBadRequest)
+			return
+		}
+
+		if len(req.Payload) == 0 {
+			req.Payload = json.RawMessage("{}")
+		}
+
+		schedule := &store.Schedule{
+			Name:      req.Name,
+			CronExpr:  req.CronExpr,
+			JobType:   req.JobType,
+			Payload:   req.Payload,
+			Enabled:   req.Enabled == nil || *req.Enabled,
+			NextRunAt: nextRunAt,
+		}
+
+		if err := services.DB.CreateSchedule(schedule); err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Failed to create schedule"}, http.StatusInternalServerError)
+			return
+		}
+
+		created, err := services.DB.GetSchedule(schedule.ID)
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Failed to get schedule"}, http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, APIResponse{Success: true, Data: created})
+	}
+}
+
+func getScheduleHandler(services *Services) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Invalid schedule ID"}, http.StatusBadRequest)
+			return
+		}
+
+		schedule, err := services.DB.GetSchedule(id)
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Schedule not found"}, http.StatusNotFound)
+			return
+		}
+
+		respondJSON(w, APIResponse{Success: true, Data: schedule})
+	}
+}
+
+func updateScheduleHandler(services *Services) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Invalid schedule ID"}, http.StatusBadRequest)
+			return
+		}
+
+		var req struct {
+			CronExpr *string         `json:"cron_expr"`
+			JobType  *string         `json:"job_type"`
+			Payload  json.RawMessage `json:"payload"`
+			Enabled  *bool           `json:"enabled"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Invalid request"}, http.StatusBadRequest)
+			return
+		}
+
+		schedule, err := services.DB.GetSchedule(id)
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Schedule not found"}, http.StatusNotFound)
+			return
+		}
+
+		// Recompute the next occurrence when the timing changes or the
+		// schedule is re-enabled, so no stale occurrence fires
+		reschedule := false
+		if req.CronExpr != nil {
+			schedule.CronExpr = *req.CronExpr
+			reschedule = true
+		}
+		if req.JobType != nil {
+			if !services.Queue.Registered(*req.JobType) {
+				respondJSON(w, APIResponse{Success: false, Error: fmt.Sprintf("Unknown job type: %s", *req.JobType)}, http.StatusBadRequest)
+				return
+			}
+			schedule.JobType = *req.JobType
+		}
+		if len(req.Payload) > 0 {
+			schedule.Payload = req.Payload
+		}
+		if req.Enabled != nil {
+			if *req.Enabled && !schedule.Enabled {
+				reschedule = true
+			}
+			schedule.Enabled = *req.Enabled
+		}
+
+		cron, err := jobs.ParseCron(schedule.CronExpr)
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: fmt.Sprintf("Invalid cron expression: %v", err)}, http.StatusBadRequest)
+			return
+		}
+		if reschedule {
+			schedule.NextRunAt = cron.Next(time.Now())
+			if schedule.NextRunAt.IsZero() {
+				respondJSON(w, APIResponse{Success: false, Error: "Cron expression never fires"}, http.StatusBadRequest)
+				return
+			}
+		}
+
+		if err := services.DB.UpdateSchedule(schedule); err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Failed to update schedule"}, http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, APIResponse{Success: true, Data: schedule})
+	}
+}
+
+func deleteScheduleHandler(services *Services) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Invalid schedule ID"}, http.StatusBadRequest)
+			return
+		}
+
+		if _, err := services.DB.GetSchedule(id); err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Schedule not found"}, http.StatusNotFound)
+			return
+		}
+
+		if err := services.DB.DeleteSchedule(id); err != nil {
+			respondJSON(w, APIResponse{Success: false, Error: "Failed to delete schedule"}, http.StatusInternalServerError)
+			return
+		}
+
+		respondJSON(w, APIResponse{Success: true, Data: map[string]string{"message": "Schedule deleted"}})
+	}
+}
+
+// jobFilterFromQuery reads the type, queue, limit and offset query parameters
+func jobFilterFromQuery(r *http.Request) store.JobFilter {
+	query := r.URL.Query()
+	filter := store.JobFilter{Type: query.Get("type"), Queue: query.Get("queue")}
+	filter.Limit, _ = strconv.Atoi(query.Get("limit"))
+	filter.Offset, _ = strconv.Atoi(query.Get("offset"))
+	return filter
+}
+
 func respondJSON(w http.ResponseWriter, response APIResponse, statusCode ...int) {
 	w.Header().Set("Content-Type", "application/json")
 	
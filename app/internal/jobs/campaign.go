@@ -0,0 +1,213 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"newsletter/internal/store"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultBatchSize is the number of recipients per send_batch job.
+const DefaultBatchSize = 500
+
+// maxThrottleWait is the longest a batch waits inline for a sending slot;
+// recipients that would wait longer are left for the snoozed batch.
+const maxThrottleWait = 2 * time.Second
+
+// campaignJobTypes are the jobs that make up a campaign send
+var campaignJobTypes = []string{"plan_campaign", "send_batch"}
+
+type PlanCampaignPayload struct {
+	CampaignID int `json:"campaign_id"`
+}
+
+// CampaignSendKey is the unique key of a campaign's plan job. It makes
+// scheduling idempotent: a double-click or client retry gets the queued or
+// running plan job back instead of a second one.
+func CampaignSendKey(campaignID int) string {
+	return fmt.Sprintf("campaign:%d:send", campaignID)
+}
+
+// StartCampaign moves a draft campaign to status ("scheduled" or "sending")
+// and enqueues its plan job to run at runAt, atomically. It returns nil and
+// no error if the campaign is no longer a draft.
+func (q *Queue) StartCampaign(campaignID int, status string, runAt time.Time) (*store.Job, error) {
+	payload, err := json.Marshal(PlanCampaignPayload{CampaignID: campaignID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	job := q.newJob("plan_campaign", payload, runAt, WithUniqueKey(CampaignSendKey(campaignID)), WithCampaign(campaignID))
+	started, err := q.db.StartCampaign(campaignID, status, job)
+	if err != nil || !started {
+		return nil, err
+	}
+
+	q.notify(job.Queue)
+	return job, nil
+}
+
+// CampaignPlanner expands a campaign into send_batch jobs and moves the
+// campaign to sent or failed once all of them have finished.
+type CampaignPlanner struct {
+	queue     *Queue
+	db        *store.Store
+	batchSize int
+}
+
+func NewCampaignPlanner(queue *Queue, batchSize int) *CampaignPlanner {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	return &CampaignPlanner{queue: queue, db: queue.db, batchSize: batchSize}
+}
+
+// PlanCampaignHandler resolves the campaign's list to its active,
+// non-suppressed subscribers, adds them to the campaign's recipient ledger
+// and enqueues the ledger in batches. The ledger keeps its order across
+// retries and each batch has a unique key, so a retried plan enqueues the
+// same batches rather than new ones, and skips those already enqueued.
+func (p *CampaignPlanner) PlanCampaignHandler(ctx context.Context, payload json.RawMessage) error {
+	var pl PlanCampaignPayload
+	if err := json.Unmarshal(payload, &pl); err != nil {
+		return Permanent(fmt.Errorf("failed to unmarshal plan campaign payload: %w", err))
+	}
+
+	campaign, err := p.db.GetCampaign(pl.CampaignID)
+	if err == sql.ErrNoRows {
+		return Permanent(fmt.Errorf("campaign %d not found", pl.CampaignID))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get campaign: %w", err)
+	}
+
+	switch campaign.Status {
+	case "scheduled":
+		if err := p.db.UpdateCampaignStatus(campaign.ID, "sending"); err != nil {
+			return fmt.Errorf("failed to update campaign status: %w", err)
+		}
+	case "sending":
+		// Retry of a plan that already started
+	default:
+		logrus.Warnf("Campaign %d is %s, not planning it", campaign.ID, campaign.Status)
+		return nil
+	}
+
+	subscribers, err := p.db.GetSendableListMembers(campaign.ListID)
+	if err != nil {
+		return fmt.Errorf("failed to get list members: %w", err)
+	}
+	if err := p.db.AddCampaignRecipients(campaign.ID, subscribers); err != nil {
+		return fmt.Errorf("failed to add campaign recipients: %w", err)
+	}
+
+	emails, err := p.db.GetCampaignRecipientEmails(campaign.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get campaign recipients: %w", err)
+	}
+
+	var batches [][]string
+	var sizes []int
+	for start := 0; start < len(emails); start += p.batchSize {
+		end := start + p.batchSize
+		if end > len(emails) {
+			end = len(emails)
+		}
+		batches = append(batches, emails[start:end])
+		sizes = append(sizes, end-start)
+	}
+
+	// A warming-up sending domain caps what goes out today; later batches
+	// are scheduled for the days with allowance left
+	domain, err := p.queue.sendingDomain(campaign)
+	if err != nil {
+		return err
+	}
+	runTimes, err := p.queue.warmupRunTimes(domain, sizes)
+	if err != nil {
+		return err
+	}
+
+	later := 0
+	for i, recipients := range batches {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		// Unique keys only cover live jobs; a batch that already ran must
+		// not run again
+		key := fmt.Sprintf("campaign:%d:batch:%d", campaign.ID, i)
+		exists, err := p.db.JobKeyExists(key)
+		if err != nil {
+			return fmt.Errorf("failed to check batch %d: %w", i, err)
+		}
+		if exists {
+			continue
+		}
+
+		batch := SendBatchPayload{CampaignID: campaign.ID, Recipients: recipients}
+		if _, err := p.queue.Enqueue("send_batch", batch, runTimes[i], WithUniqueKey(key), WithCampaign(campaign.ID)); err != nil {
+			return fmt.Errorf("failed to enqueue batch %d: %w", i, err)
+		}
+		if runTimes[i].After(time.Now()) {
+			later++
+		}
+	}
+
+	logrus.Infof("Planned campaign %d: %d recipients in %d batches", campaign.ID, len(emails), len(batches))
+	if later > 0 {
+		logrus.Infof("Campaign %d: %d batches held back by the warm-up of %s", campaign.ID, later, domain.Domain)
+	}
+	return nil
+}
+
+// JobFinished is the finish hook for campaign jobs. Once none of the
+// campaign's jobs are queued or running, the campaign is marked failed if
+// any of them failed and sent otherwise. A campaign without recipients is
+// marked sent as soon as its plan is done.
+func (p *CampaignPlanner) JobFinished(job *store.Job, status string) {
+	if job.CampaignID == 0 {
+		logrus.Errorf("Job %d has no campaign", job.ID)
+		return
+	}
+
+	counts, err := p.db.CountCampaignJobs(job.CampaignID, campaignJobTypes...)
+	if err != nil {
+		logrus.Errorf("Failed to count jobs for campaign %d: %v", job.CampaignID, err)
+		return
+	}
+	if counts["queued"] > 0 || counts["running"] > 0 {
+		return
+	}
+
+	campaign, err := p.db.GetCampaign(job.CampaignID)
+	if err != nil {
+		logrus.Errorf("Failed to get campaign %d: %v", job.CampaignID, err)
+		return
+	}
+	// A plan can fail before the campaign left scheduled, and a failed
+	// campaign can still become sent once its dead-lettered jobs are retried
+	switch campaign.Status {
+	case "scheduled", "sending", "failed":
+	default:
+		return
+	}
+
+	result := "sent"
+	if counts["failed"] > 0 {
+		result = "failed"
+	}
+	if result == campaign.Status {
+		return
+	}
+
+	if err := p.db.UpdateCampaignStatus(campaign.ID, result); err != nil {
+		logrus.Errorf("Failed to mark campaign %d as %s: %v", campaign.ID, result, err)
+		return
+	}
+	logrus.Infof("Campaign %d %s (%d jobs done, %d failed)", campaign.ID, result, counts["done"], counts["failed"])
+}
@@ -0,0 +1,146 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{"* * * * *", false},
+		{"*/15 * * * *", false},
+		{"0,30 9-17 * * 1-5", false},
+		{"0 0 1-31/2 * *", false},
+		{"5/10 * * * *", false},
+		{"0 0 ? * 7", false},
+		{"@hourly", false},
+		{"@Daily", false},
+		{"  @weekly  ", false},
+		{"", true},
+		{"* * * *", true},
+		{"* * * * * *", true},
+		{"60 * * * *", true},
+		{"* 24 * * *", true},
+		{"* * 0 * *", true},
+		{"* * 32 * *", true},
+		{"* * * 0 *", true},
+		{"* * * 13 *", true},
+		{"* * * * 8", true},
+		{"*/0 * * * *", true},
+		{"*/x * * * *", true},
+		{"5-1 * * * *", true},
+		{"a * * * *", true},
+		{"1- * * * *", true},
+		{"@every 5m", true},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseCron(tt.expr)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseCron(%q) error = %v, wantErr %v", tt.expr, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseCronFields(t *testing.T) {
+	s, err := ParseCron("0,30 9-11 */10 1-12/6 7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := uint64(1<<0 | 1<<30); s.minute != want {
+		t.Errorf("minute = %b, want %b", s.minute, want)
+	}
+	if want := uint64(1<<9 | 1<<10 | 1<<11); s.hour != want {
+		t.Errorf("hour = %b, want %b", s.hour, want)
+	}
+	if want := uint64(1<<1 | 1<<11 | 1<<21 | 1<<31); s.dom != want {
+		t.Errorf("dom = %b, want %b", s.dom, want)
+	}
+	if want := uint64(1<<1 | 1<<7); s.month != want {
+		t.Errorf("month = %b, want %b", s.month, want)
+	}
+	// 7 is Sunday, i.e. 0
+	if s.dow&1 == 0 {
+		t.Errorf("dow = %b, want Sunday (bit 0) set", s.dow)
+	}
+	if s.domStar || s.dowStar {
+		t.Errorf("domStar = %v, dowStar = %v, want both false", s.domStar, s.dowStar)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		t.Helper()
+		v, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	tests := []struct {
+		expr string
+		from string
+		want string // "" for no occurrence
+	}{
+		// Strictly after the given time
+		{"* * * * *", "2026-10-16 10:07", "2026-10-16 10:08"},
+		{"0 * * * *", "2026-10-16 10:00", "2026-10-16 11:00"},
+		{"*/15 * * * *", "2026-10-16 10:07", "2026-10-16 10:15"},
+		{"*/15 * * * *", "2026-10-16 23:50", "2026-10-17 00:00"},
+		{"30 3 * * *", "2026-10-16 03:30", "2026-10-17 03:30"},
+		// Weekdays: Friday 2026-10-16 after 03:30 rolls over the weekend
+		{"30 3 * * 1-5", "2026-10-16 04:00", "2026-10-19 03:30"},
+		{"0 0 * * 0", "2026-10-16 00:00", "2026-10-18 00:00"},
+		{"0 0 * * 7", "2026-10-16 00:00", "2026-10-18 00:00"},
+		// Both day fields restricted: either one matching is enough
+		{"0 0 13 * 5", "2026-10-01 00:00", "2026-10-02 00:00"},
+		{"0 0 13 * 5", "2026-10-10 00:00", "2026-10-13 00:00"},
+		// Only one restricted: that one decides
+		{"0 0 13 * *", "2026-10-01 00:00", "2026-10-13 00:00"},
+		{"0 0 * * 5", "2026-10-10 00:00", "2026-10-16 00:00"},
+		{"0 0 13 * ?", "2026-10-14 00:00", "2026-11-13 00:00"},
+		// Month and year boundaries
+		{"0 0 31 * *", "2026-10-31 12:00", "2026-12-31 00:00"},
+		{"0 0 1 1 *", "2026-12-31 23:59", "2027-01-01 00:00"},
+		{"0 0 29 2 *", "2026-03-01 00:00", "2028-02-29 00:00"},
+		{"@monthly", "2026-10-16 10:00", "2026-11-01 00:00"},
+		{"@yearly", "2026-10-16 10:00", "2027-01-01 00:00"},
+		{"@weekly", "2026-10-16 10:00", "2026-10-18 00:00"},
+		// Never fires
+		{"0 0 30 2 *", "2026-10-16 10:00", ""},
+		{"0 0 31 4,6,9,11 *", "2026-10-16 10:00", ""},
+	}
+
+	for _, tt := range tests {
+		s, err := ParseCron(tt.expr)
+		if err != nil {
+			t.Fatalf("ParseCron(%q): %v", tt.expr, err)
+		}
+
+		got := s.Next(at(tt.from))
+		if tt.want == "" {
+			if !got.IsZero() {
+				t.Errorf("%q after %s = %s, want none", tt.expr, tt.from, got.Format(time.RFC3339))
+			}
+			continue
+		}
+		if want := at(tt.want); !got.Equal(want) {
+			t.Errorf("%q after %s = %s, want %s", tt.expr, tt.from, got.Format(time.RFC3339), want.Format(time.RFC3339))
+		}
+	}
+}
+
+func TestCronNextTruncatesSeconds(t *testing.T) {
+	s, err := ParseCron("* * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2026, 10, 16, 10, 7, 59, 999, time.UTC)
+	if got, want := s.Next(from), time.Date(2026, 10, 16, 10, 8, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("Next(%s) = %s, want %s", from, got, want)
+	}
+}
@@ -0,0 +1,251 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"newsletter/internal/deliverability"
+	"newsletter/internal/mail"
+	"newsletter/internal/store"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultDKIMRetireGrace is how long a replaced key stays published so
+	// that mail signed with it shortly before the switch still verifies
+	DefaultDKIMRetireGrace = 7 * 24 * time.Hour
+
+	// dkimDNSCheckInterval is how often a pending key's DNS record is checked
+	dkimDNSCheckInterval = 10 * time.Minute
+	// dkimPublishTimeout is how long a pending key waits for its DNS record
+	// before the rotation is given up
+	dkimPublishTimeout = 7 * 24 * time.Hour
+)
+
+// ErrRotationPending is returned by StartRotation when the domain already
+// has a key of the algorithm waiting to be published.
+var ErrRotationPending = errors.New("a DKIM key rotation is already pending")
+
+type DKIMRotationPayload struct {
+	DomainID int `json:"domain_id"`
+	KeyID    int `json:"key_id"`
+}
+
+// DKIMRotator rotates DKIM keys without a window in which mail is signed
+// with a key that is not in DNS: a new key is generated under a new
+// selector and only signs once its record is visible, and the old key
+// stays published for a grace period before it is retired.
+type DKIMRotator struct {
+	queue   *Queue
+	db      *store.Store
+	checker *deliverability.Service
+	grace   time.Duration
+}
+
+func NewDKIMRotator(queue *Queue, checker *deliverability.Service, grace time.Duration) *DKIMRotator {
+	if grace <= 0 {
+		grace = DefaultDKIMRetireGrace
+	}
+	return &DKIMRotator{queue: queue, db: queue.db, checker: checker, grace: grace}
+}
+
+// StartRotation generates a pending key of algorithm ("rsa" or "ed25519")
+// under a dated selector and enqueues the job that activates it once its
+// DNS record, returned alongside the key, has been published.
+func (r *DKIMRotator) StartRotation(domain *store.Domain, algorithm string) (*store.DomainKey, string, error) {
+	keys, err := r.db.GetDomainKeys(domain.ID)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get domain keys: %w", err)
+	}
+
+	selectors := make(map[string]bool)
+	for _, key := range keys {
+		if key.Algorithm == algorithm && key.Status == "pending" {
+			return nil, "", ErrRotationPending
+		}
+		selectors[key.Selector] = true
+	}
+
+	var privateKey, publicKey string
+	prefix := "newsletter"
+	switch algorithm {
+	case "rsa":
+		privateKey, publicKey, err = mail.GenerateDKIMKeys()
+	case "ed25519":
+		prefix = "newsletter-ed25519"
+		privateKey, publicKey, err = mail.GenerateEd25519DKIMKeys()
+	default:
+		return nil, "", fmt.Errorf("unsupported DKIM algorithm %q", algorithm)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to generate DKIM keys: %w", err)
+	}
+
+	// Selectors are dated so that DNS caches can never hand out the old
+	// record for the new key; a second rotation on the same day gets a suffix
+	selector := prefix + "-" + time.Now().UTC().Format("20060102")
+	for i := 2; selectors[selector]; i++ {
+		selector = fmt.Sprintf("%s-%s-%d", prefix, time.Now().UTC().Format("20060102"), i)
+	}
+
+	record, err := mail.DKIMRecord(publicKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	key := &store.DomainKey{
+		DomainID:   domain.ID,
+		Algorithm:  algorithm,
+		Selector:   selector,
+		PrivateKey: privateKey,
+		PublicKey:  publicKey,
+	}
+	message := fmt.Sprintf("publish TXT %s._domainkey.%s: %s", selector, domain.Domain, record)
+	if err := r.db.CreatePendingDomainKey(key, message); err != nil {
+		return nil, "", fmt.Errorf("failed to create domain key: %w", err)
+	}
+
+	payload := DKIMRotationPayload{DomainID: domain.ID, KeyID: key.ID}
+	if _, err := r.queue.Enqueue("rotate_dkim", payload, time.Now(), WithUniqueKey(fmt.Sprintf("dkim-key:%d:rotate", key.ID))); err != nil {
+		return nil, "", fmt.Errorf("failed to enqueue DKIM rotation: %w", err)
+	}
+
+	logrus.Infof("Started %s DKIM rotation for %s with selector %s", algorithm, domain.Domain, selector)
+	return key, record, nil
+}
+
+// DKIMRotationHandler drives a key through its rotation. A pending key is
+// activated once the deliverability checker finds its record in DNS; the
+// job then waits out the grace period and retires the key it replaced.
+// Waiting is done by snoozing, so it costs no attempts.
+func (r *DKIMRotator) DKIMRotationHandler(ctx context.Context, payload json.RawMessage) error {
+	var p DKIMRotationPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return Permanent(fmt.Errorf("failed to unmarshal DKIM rotation payload: %w", err))
+	}
+
+	key, err := r.db.GetDomainKey(p.KeyID)
+	if err == sql.ErrNoRows {
+		return Permanent(fmt.Errorf("domain key %d not found", p.KeyID))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get domain key: %w", err)
+	}
+
+	domain, err := r.db.GetDomain(key.DomainID)
+	if err == sql.ErrNoRows {
+		return Permanent(fmt.Errorf("domain %d not found", key.DomainID))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get domain: %w", err)
+	}
+
+	switch key.Status {
+	case "pending":
+		return r.activate(domain, key)
+	case "active":
+		return r.retireReplaced(domain, key)
+	default:
+		logrus.Infof("DKIM key %d of %s is %s, nothing to do", key.ID, domain.Domain, key.Status)
+		return nil
+	}
+}
+
+// JobFinished is the finish hook for rotate_dkim jobs. A key whose job was
+// dead-lettered while it was still pending is marked failed, so that it
+// does not block the next rotation of its algorithm.
+func (r *DKIMRotator) JobFinished(job *store.Job, status string) {
+	if status != "failed" {
+		return
+	}
+
+	var p DKIMRotationPayload
+	if err := json.Unmarshal(job.Payload, &p); err != nil || p.KeyID == 0 {
+		logrus.Errorf("Job %d has no domain key in its payload", job.ID)
+		return
+	}
+	key, err := r.db.GetDomainKey(p.KeyID)
+	if err != nil {
+		logrus.Errorf("Failed to get domain key %d: %v", p.KeyID, err)
+		return
+	}
+	if key.Status != "pending" {
+		return
+	}
+
+	message := "rotation job failed"
+	if failed, err := r.db.GetJob(job.ID); err == nil && failed.LastError != "" {
+		message += ": " + failed.LastError
+	}
+	if err := r.db.UpdateDomainKeyStatus(key, "failed", message); err != nil {
+		logrus.Errorf("Failed to mark domain key %d as failed: %v", key.ID, err)
+		return
+	}
+	logrus.Warnf("DKIM rotation to selector %s failed: %s", key.Selector, message)
+}
+
+func (r *DKIMRotator) activate(domain *store.Domain, key *store.DomainKey) error {
+	result, err := r.checker.CheckDKIM(domain.Domain, key.Selector, key.PublicKey)
+	if err != nil || result.Status != "pass" {
+		if time.Since(key.CreatedAt) > dkimPublishTimeout {
+			message := fmt.Sprintf("DNS record not published within %s: %s", dkimPublishTimeout, result.Message)
+			if err := r.db.UpdateDomainKeyStatus(key, "failed", message); err != nil {
+				return fmt.Errorf("failed to update domain key: %w", err)
+			}
+			logrus.Warnf("DKIM rotation for %s gave up on selector %s", domain.Domain, key.Selector)
+			return nil
+		}
+
+		logrus.Infof("DKIM record %s._domainkey.%s not visible yet: %s", key.Selector, domain.Domain, result.Message)
+		return Snooze(dkimDNSCheckInterval)
+	}
+
+	if err := r.db.AddDomainKeyHistory(domain.ID, key.ID, "verified", "DNS record found"); err != nil {
+		return fmt.Errorf("failed to record key history: %w", err)
+	}
+
+	retireAt := time.Now().Add(r.grace)
+	if err := r.db.ActivateDomainKey(key, retireAt); err != nil {
+		return fmt.Errorf("failed to activate domain key: %w", err)
+	}
+
+	logrus.Infof("Switched %s DKIM signing for %s to selector %s", key.Algorithm, domain.Domain, key.Selector)
+	return Snooze(time.Until(retireAt))
+}
+
+// retireReplaced retires the keys that key replaced once their grace period
+// is over.
+func (r *DKIMRotator) retireReplaced(domain *store.Domain, key *store.DomainKey) error {
+	keys, err := r.db.GetDomainKeys(domain.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get domain keys: %w", err)
+	}
+
+	var next time.Time
+	for _, old := range keys {
+		if old.Algorithm != key.Algorithm || old.Status != "retiring" || old.RetireAt == nil {
+			continue
+		}
+		if old.RetireAt.After(time.Now()) {
+			if next.IsZero() || old.RetireAt.Before(next) {
+				next = *old.RetireAt
+			}
+			continue
+		}
+
+		message := fmt.Sprintf("grace period over, remove TXT %s._domainkey.%s", old.Selector, domain.Domain)
+		if err := r.db.UpdateDomainKeyStatus(old, "retired", message); err != nil {
+			return fmt.Errorf("failed to retire domain key: %w", err)
+		}
+		logrus.Infof("Retired DKIM selector %s of %s", old.Selector, domain.Domain)
+	}
+
+	if !next.IsZero() {
+		return Snooze(time.Until(next))
+	}
+	return nil
+}
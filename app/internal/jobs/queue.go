@@ -2,98 +2,475 @@ package jobs
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"newsletter/internal/mail"
 	"newsletter/internal/store"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// leaseDuration is how long a claimed job stays reserved for a worker
+	// without a heartbeat before it is considered abandoned
+	leaseDuration = 2 * time.Minute
+	// heartbeatInterval must be comfortably shorter than leaseDuration
+	heartbeatInterval = 30 * time.Second
+)
+
+// DefaultQueue receives jobs whose type was not registered on a named queue.
+const DefaultQueue = "default"
+
 type Queue struct {
-	db *store.Store
+	db       *store.Store
+	mail     *mail.Service
+	instance string
+
+	handlers map[string]registration
+	// finishHooks run when a job of the type reaches done or failed
+	finishHooks map[string][]FinishFunc
+
+	// wake holds one channel per named queue used to wake idle workers
+	wakeMu sync.Mutex
+	wake   map[string]chan struct{}
+
+	// wg tracks running workers so Shutdown can wait for them to drain
+	wg sync.WaitGroup
+	// jobCtx is the parent of every handler context; cancelJobs aborts
+	// in-flight jobs once the shutdown drain deadline has passed
+	jobCtx     context.Context
+	cancelJobs context.CancelFunc
 }
 
 type JobHandler func(ctx context.Context, payload json.RawMessage) error
 
-func NewQueue(db *store.Store) *Queue {
-	return &Queue{db: db}
+// FinishFunc is called once a job has been marked done or failed, with the
+// job as it was claimed and its final status.
+type FinishFunc func(job *store.Job, status string)
+
+type registration struct {
+	handler  JobHandler
+	policy   RetryPolicy
+	defaults []EnqueueOption
+}
+
+// EnqueueOption adjusts a job before it is stored.
+type EnqueueOption func(job *store.Job)
+
+// WithQueue places the job on a named queue.
+func WithQueue(name string) EnqueueOption {
+	return func(job *store.Job) {
+		job.Queue = name
+	}
+}
+
+// WithUniqueKey makes the enqueue idempotent: if a job with key is already
+// queued or running, Enqueue returns it instead of adding another.
+// Keys are free-form, e.g. "campaign:42:send".
+func WithUniqueKey(key string) EnqueueOption {
+	return func(job *store.Job) {
+		job.UniqueKey = key
+	}
+}
+
+// WithCampaign records the campaign the job belongs to, which the
+// campaign's completion check counts it under.
+func WithCampaign(campaignID int) EnqueueOption {
+	return func(job *store.Job) {
+		job.CampaignID = campaignID
+	}
+}
+
+// WithPriority sets the job priority. Higher priorities are claimed first
+// among due jobs on the same queue.
+func WithPriority(priority int) EnqueueOption {
+	return func(job *store.Job) {
+		job.Priority = priority
+	}
+}
+
+func NewQueue(db *store.Store, mailService *mail.Service) *Queue {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	jobCtx, cancelJobs := context.WithCancel(context.Background())
+
+	return &Queue{
+		db:          db,
+		mail:        mailService,
+		instance:    fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+		handlers:    make(map[string]registration),
+		finishHooks: make(map[string][]FinishFunc),
+		wake:        make(map[string]chan struct{}),
+		jobCtx:      jobCtx,
+		cancelJobs:  cancelJobs,
+	}
 }
 
-func (q *Queue) Enqueue(jobType string, payload interface{}, runAt time.Time) error {
+// Enqueue stores a job to run at runAt and returns it. The job goes to the
+// queue and priority registered for its type unless opts override them.
+// With WithUniqueKey, a duplicate enqueue returns the existing job.
+func (q *Queue) Enqueue(jobType string, payload interface{}, runAt time.Time, opts ...EnqueueOption) (*store.Job, error) {
 	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
-		return fmt.Errorf("failed to marshal payload: %w", err)
+		return nil, fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	job := q.newJob(jobType, payloadBytes, runAt, opts...)
+	created, err := q.db.EnqueueJob(job)
+	if err != nil {
+		return nil, err
+	}
+	if !created {
+		logrus.Infof("Job with key %s already exists as job %d (%s), not enqueuing again", job.UniqueKey, job.ID, job.Status)
+		return job, nil
+	}
+
+	q.notify(job.Queue)
+	return job, nil
+}
+
+func (q *Queue) newJob(jobType string, payload json.RawMessage, runAt time.Time, opts ...EnqueueOption) *store.Job {
+	job := &store.Job{
+		Type:    jobType,
+		Queue:   DefaultQueue,
+		Payload: payload,
+		RunAt:   runAt,
+	}
+	for _, opt := range q.handlers[jobType].defaults {
+		opt(job)
+	}
+	for _, opt := range opts {
+		opt(job)
+	}
+	return job
+}
+
+// Retry moves a job from the dead-letter queue back to its queue and wakes
+// a worker for it.
+func (q *Queue) Retry(job *store.Job) error {
+	if err := q.db.RetryJob(job.ID); err != nil {
+		return err
+	}
+	q.notify(job.Queue)
+	return nil
+}
+
+// Registered reports whether a handler exists for jobType.
+func (q *Queue) Registered(jobType string) bool {
+	_, ok := q.handlers[jobType]
+	return ok
+}
+
+// Register sets the handler and retry policy for jobType, plus the default
+// queue and priority for jobs of that type. It must be called before
+// RunWorkers. A zero MaxAttempts selects DefaultRetryPolicy.
+func (q *Queue) Register(jobType string, handler JobHandler, policy RetryPolicy, opts ...EnqueueOption) {
+	if policy.MaxAttempts <= 0 {
+		policy = DefaultRetryPolicy
+	}
+	q.handlers[jobType] = registration{handler: handler, policy: policy, defaults: opts}
+}
+
+// OnFinish adds fn to the hooks run when a job of jobType is done or moved
+// to the dead-letter queue, whether by its worker or by the reaper. Like
+// Register, it must be called before RunWorkers.
+func (q *Queue) OnFinish(jobType string, fn FinishFunc) {
+	q.finishHooks[jobType] = append(q.finishHooks[jobType], fn)
+}
+
+// finished runs the finish hooks for job
+func (q *Queue) finished(job *store.Job, status string) {
+	for _, fn := range q.finishHooks[job.Type] {
+		fn(job, status)
 	}
+}
 
-	return q.db.EnqueueJob(jobType, payloadBytes, runAt)
+// queueFor returns the queue jobs of jobType are enqueued on by default
+func (q *Queue) queueFor(jobType string) string {
+	return q.newJob(jobType, nil, time.Time{}).Queue
+}
+
+func (q *Queue) policyFor(jobType string) RetryPolicy {
+	if reg, ok := q.handlers[jobType]; ok {
+		return reg.policy
+	}
+	return DefaultRetryPolicy
 }
 
-func (q *Queue) RunWorkers(numWorkers int, handlers map[string]JobHandler) {
-	for i := 0; i < numWorkers; i++ {
-		go q.worker(fmt.Sprintf("worker-%d", i), handlers)
+// RunWorkers starts the given number of workers per named queue, e.g.
+// {"sending": 8, "bounces": 2, "maintenance": 1}. Workers stop claiming new
+// jobs once ctx is cancelled; use Shutdown to wait for in-flight jobs.
+func (q *Queue) RunWorkers(ctx context.Context, concurrency map[string]int) {
+	for jobType := range q.handlers {
+		if name := q.queueFor(jobType); concurrency[name] <= 0 {
+			logrus.Warnf("No workers for queue %s, %s jobs will not run", name, jobType)
+		}
+	}
+
+	for name, numWorkers := range concurrency {
+		for i := 0; i < numWorkers; i++ {
+			// Worker names include the host and pid so leases stay unambiguous
+			// when several server processes share the same database
+			q.wg.Add(1)
+			go q.worker(ctx, name, fmt.Sprintf("%s/%s-%d", q.instance, name, i))
+		}
 	}
 }
 
-func (q *Queue) worker(name string, handlers map[string]JobHandler) {
+// ParseConcurrency parses a per-queue worker count specification such as
+// "sending=8,bounces=2,maintenance=1".
+func ParseConcurrency(spec string) (map[string]int, error) {
+	concurrency := make(map[string]int)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, count, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid queue concurrency %q, expected name=count", part)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(count))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid worker count for queue %s: %q", name, count)
+		}
+		concurrency[strings.TrimSpace(name)] = n
+	}
+	return concurrency, nil
+}
+
+// Shutdown waits for workers to finish their current job. If ctx expires
+// first, in-flight handler contexts are cancelled and their jobs released
+// back to the queue.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	drained := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	logrus.Warn("Drain deadline reached, cancelling in-flight jobs")
+	q.cancelJobs()
+
+	// Give cancelled handlers a moment to return and release their jobs;
+	// anything still stuck after that is left for the reaper
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		logrus.Warn("Some jobs did not stop after cancellation")
+	}
+	return ctx.Err()
+}
+
+func (q *Queue) worker(ctx context.Context, queueName, name string) {
+	defer q.wg.Done()
 	logrus.Infof("Starting worker: %s", name)
+
+	wake := q.wakeChan(queueName)
 	
 	for {
-		// Get next job
-		job, err := q.db.GetNextJob()
+		if ctx.Err() != nil {
+			logrus.Infof("Stopping worker: %s", name)
+			return
+		}
+
+		// Claim next job
+		job, err := q.db.ClaimJob(queueName, name, leaseDuration)
 		if err != nil {
-			if err.Error() == "sql: no rows in result set" {
-				// No jobs available, wait a bit
-				time.Sleep(5 * time.Second)
-				continue
+			wait := idlePollInterval
+			if err == sql.ErrNoRows {
+				// Nothing due: sleep until the next job is, or until an
+				// enqueue wakes us
+				wait = q.idleWait(queueName)
+			} else {
+				logrus.Errorf("Failed to claim next job: %v", err)
+			}
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+			case <-wake:
+			case <-timer.C:
 			}
-			logrus.Errorf("Failed to get next job: %v", err)
-			time.Sleep(5 * time.Second)
+			timer.Stop()
 			continue
 		}
 
-		// Mark job as running
-		if err := q.db.UpdateJobStatus(job.ID, "running"); err != nil {
-			logrus.Errorf("Failed to update job status to running: %v", err)
+		// There may be more due jobs; pass the wakeup on to another idle
+		// worker instead of leaving it asleep
+		q.notify(queueName)
+
+		// Process job, keeping the lease alive while the handler runs
+		jobCtx, cancel := context.WithTimeout(q.jobCtx, 30*time.Minute)
+		stopHeartbeat := q.heartbeat(jobCtx, cancel, job, name)
+		err = q.processJob(jobCtx, job)
+		stopHeartbeat()
+		cancel()
+
+		// A job interrupted by shutdown did not really fail; put it back
+		// without counting the attempt
+		if err != nil && q.jobCtx.Err() != nil {
+			logrus.Warnf("Job %d interrupted by shutdown, releasing: %v", job.ID, err)
+			q.finish(job, name, "queued")
 			continue
 		}
 
-		// Process job
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
-		err = q.processJob(ctx, job, handlers)
-		cancel()
+		if delay, ok := snoozeDuration(err); ok {
+			q.snooze(job, name, delay)
+			continue
+		}
 
 		// Update job status
 		if err != nil {
 			logrus.Errorf("Job %d failed: %v", job.ID, err)
-			
-			// Increment attempts
-			if err := q.db.IncrementJobAttempts(job.ID); err != nil {
-				logrus.Errorf("Failed to increment job attempts: %v", err)
-			}
-			
-			// Check if we should retry
-			if job.Attempts >= 3 {
-				q.db.UpdateJobStatus(job.ID, "failed")
-			} else {
-				// Retry with exponential backoff
-				retryAt := time.Now().Add(time.Duration(job.Attempts+1) * time.Minute)
-				q.db.EnqueueJob(job.Type, job.Payload, retryAt)
-				q.db.UpdateJobStatus(job.ID, "queued")
+
+			// Keep the error with the job so it can be inspected later
+			if err := q.db.RecordJobError(job.ID, job.Attempts+1, name, err.Error()); err != nil {
+				logrus.Errorf("Failed to record error for job %d: %v", job.ID, err)
 			}
+
+			q.retryOrFail(job, name, err)
 		} else {
-			q.db.UpdateJobStatus(job.ID, "done")
+			q.finish(job, name, "done")
 		}
 	}
 }
 
-func (q *Queue) processJob(ctx context.Context, job *store.Job, handlers map[string]JobHandler) error {
-	handler, exists := handlers[job.Type]
+// heartbeat periodically extends the lease on job until the returned stop
+// function is called. If the lease is lost the job context is cancelled so
+// the handler stops working on a job that may now belong to someone else.
+func (q *Queue) heartbeat(ctx context.Context, cancel context.CancelFunc, job *store.Job, worker string) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(heartbeatInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				err := q.db.HeartbeatJob(job.ID, worker, leaseDuration)
+				if err == store.ErrLeaseLost {
+					logrus.Warnf("Worker %s lost lease on job %d, cancelling", worker, job.ID)
+					cancel()
+					return
+				}
+				if err != nil {
+					logrus.Errorf("Failed to heartbeat job %d: %v", job.ID, err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// retryOrFail reschedules the same job row with exponential backoff, or
+// moves it to the dead-letter queue once its policy gives up on it.
+func (q *Queue) retryOrFail(job *store.Job, worker string, jobErr error) {
+	policy := q.policyFor(job.Type)
+	attempt := job.Attempts + 1
+
+	var err error
+	failed := true
+	switch {
+	case !policy.Retryable(jobErr):
+		logrus.Warnf("Job %d failed with a non-retryable error, moving to dead-letter queue", job.ID)
+		err = q.db.FailJob(job.ID, worker)
+	case attempt >= policy.MaxAttempts:
+		logrus.Warnf("Job %d failed %d times, moving to dead-letter queue", job.ID, attempt)
+		err = q.db.FailJob(job.ID, worker)
+	default:
+		failed = false
+		retryAt := time.Now().Add(policy.Backoff(attempt))
+		logrus.Infof("Retrying job %d at %s (attempt %d of %d)", job.ID, retryAt.Format(time.RFC3339), attempt+1, policy.MaxAttempts)
+		err = q.db.RescheduleJob(job.ID, worker, retryAt)
+		if err == nil {
+			// Idle workers may be sleeping past retryAt
+			q.notify(job.Queue)
+		}
+	}
+
+	if err == store.ErrLeaseLost {
+		logrus.Warnf("Worker %s no longer holds job %d, not updating it", worker, job.ID)
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to update failed job %d: %v", job.ID, err)
+		return
+	}
+	if failed {
+		q.finished(job, "failed")
+	}
+}
+
+// snooze puts a job that asked to wait back in the queue without counting
+// the run as an attempt.
+func (q *Queue) snooze(job *store.Job, worker string, delay time.Duration) {
+	runAt := time.Now().Add(delay)
+	err := q.db.SnoozeJob(job.ID, worker, runAt)
+	if err == store.ErrLeaseLost {
+		logrus.Warnf("Worker %s no longer holds job %d, not snoozing it", worker, job.ID)
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to snooze job %d: %v", job.ID, err)
+		return
+	}
+	logrus.Infof("Job %d snoozed until %s", job.ID, runAt.Format(time.RFC3339))
+	q.notify(job.Queue)
+}
+
+func (q *Queue) finish(job *store.Job, worker, status string) {
+	err := q.db.FinishJob(job.ID, worker, status)
+	if err == nil && status == "queued" {
+		q.notify(job.Queue)
+	}
+	if err == store.ErrLeaseLost {
+		logrus.Warnf("Worker %s no longer holds job %d, not marking it %s", worker, job.ID, status)
+		return
+	}
+	if err != nil {
+		logrus.Errorf("Failed to mark job %d as %s: %v", job.ID, status, err)
+		return
+	}
+	if status == "done" {
+		q.finished(job, status)
+	}
+}
+
+func (q *Queue) processJob(ctx context.Context, job *store.Job) error {
+	reg, exists := q.handlers[job.Type]
 	if !exists {
-		return fmt.Errorf("no handler for job type: %s", job.Type)
+		return Permanent(fmt.Errorf("no handler for job type: %s", job.Type))
 	}
 
-	return handler(ctx, job.Payload)
+	return reg.handler(ctx, job.Payload)
 }
 
 // Job payloads
@@ -108,65 +485,239 @@ type BounceProcessingPayload struct {
 	BounceType string `json:"bounce_type"`
 }
 
-type DKIMRotationPayload struct {
-	DomainID int `json:"domain_id"`
+type CleanupJobsPayload struct {
+	OlderThanDays int `json:"older_than_days"`
 }
 
 // Job handlers
+// SendBatchHandler delivers a campaign to a batch of recipients. Every
+// recipient is claimed in the campaign's ledger before sending, so a retried
+// batch skips those already sent and only resends the ones that were
+// deferred.
 func (q *Queue) SendBatchHandler(ctx context.Context, payload json.RawMessage) error {
 	var p SendBatchPayload
 	if err := json.Unmarshal(payload, &p); err != nil {
-		return fmt.Errorf("failed to unmarshal send batch payload: %w", err)
+		return Permanent(fmt.Errorf("failed to unmarshal send batch payload: %w", err))
 	}
 
 	// Get campaign
 	campaign, err := q.db.GetCampaign(p.CampaignID)
+	if err == sql.ErrNoRows {
+		return Permanent(fmt.Errorf("campaign %d not found", p.CampaignID))
+	}
 	if err != nil {
 		return fmt.Errorf("failed to get campaign: %w", err)
 	}
 
-	// Get list
-	_, err = q.db.GetList(campaign.ListID)
+	// Mail is DKIM-signed with the key of the From address's domain
+	domain, err := q.sendingDomain(campaign)
 	if err != nil {
-		return fmt.Errorf("failed to get list: %w", err)
+		return err
 	}
 
+	senderDomain := campaign.FromEmail[strings.LastIndex(campaign.FromEmail, "@")+1:]
+
 	// Process each recipient
+	deferred := 0
+	throttled := 0
+	var throttleDelay time.Duration
+	var warmupResume time.Time
+	var lastErr error
 	for _, email := range p.Recipients {
-		// Check if suppressed
-		suppressed, err := q.db.IsSuppressed(email)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		subscriber, err := q.db.GetSubscriberByEmail(email)
+		if err == sql.ErrNoRows {
+			logrus.Warnf("Subscriber %s no longer exists, skipping", email)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get subscriber %s: %w", email, err)
+		}
+
+		claimed, err := q.db.ClaimCampaignRecipient(campaign.ID, subscriber.ID, email)
 		if err != nil {
-			logrus.Errorf("Failed to check suppression for %s: %v", email, err)
+			return fmt.Errorf("failed to claim recipient %s: %w", email, err)
+		}
+		if !claimed {
+			q.skipRecipient(campaign.ID, subscriber)
 			continue
 		}
-		if suppressed {
+
+		// Subscribers may have unsubscribed or bounced since the campaign
+		// was planned
+		if reason, err := q.unsendableReason(subscriber); err != nil {
+			q.releaseRecipient(campaign.ID, subscriber.ID)
+			return err
+		} else if reason != "" {
+			q.updateRecipient(campaign.ID, subscriber.ID, "failed", "not sent: "+reason)
 			continue
 		}
 
-		// Get or create subscriber
-		subscriber, err := q.db.GetSubscriberByEmail(email)
+		// A warming-up domain that used today's allowance leaves the rest
+		// of the batch for tomorrow
+		warmupDay, resumeAt, err := q.consumeWarmup(domain)
 		if err != nil {
-			// Create new subscriber
-			subscriber, err = q.db.CreateSubscriber(email, json.RawMessage("{}"))
-			if err != nil {
-				logrus.Errorf("Failed to create subscriber %s: %v", email, err)
-				continue
+			q.releaseRecipient(campaign.ID, subscriber.ID)
+			return err
+		}
+		if !resumeAt.IsZero() {
+			q.releaseRecipient(campaign.ID, subscriber.ID)
+			warmupResume = resumeAt
+			break
+		}
+
+		// Over a rate limit: wait briefly, or leave the recipient for the
+		// snoozed batch rather than tie up the worker
+		wait, ok := q.mail.Throttle.Reserve(senderDomain, email, maxThrottleWait)
+		if !ok {
+			q.releaseWarmup(domain, warmupDay)
+			q.releaseRecipient(campaign.ID, subscriber.ID)
+			throttled++
+			if throttleDelay == 0 || wait < throttleDelay {
+				throttleDelay = wait
+			}
+			continue
+		}
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				q.releaseWarmup(domain, warmupDay)
+				q.releaseRecipient(campaign.ID, subscriber.ID)
+				return ctx.Err()
+			case <-timer.C:
 			}
 		}
 
-		// TODO: Send email
-		// This would involve creating the email message and sending it via SMTP
-		logrus.Infof("Would send email to %s for campaign %d", email, p.CampaignID)
-		
-		// Record delivery event
-		if err := q.db.RecordEvent(p.CampaignID, subscriber.ID, "delivered", nil); err != nil {
-			logrus.Errorf("Failed to record delivery event: %v", err)
+		response, err := q.deliver(ctx, campaign, subscriber, domain)
+		if err != nil {
+			if IsPermanent(err) {
+				logrus.Warnf("Permanent failure sending campaign %d to %s: %v", campaign.ID, email, err)
+				q.updateRecipient(campaign.ID, subscriber.ID, "failed", mail.Reply(err))
+				q.recordDeliveryEvent(campaign.ID, subscriber.ID, "failed", mail.Reply(err))
+				continue
+			}
+
+			logrus.Warnf("Temporary failure sending campaign %d to %s: %v", campaign.ID, email, err)
+
+			// Leave the recipient for the batch retry
+			deferred++
+			lastErr = err
+			q.releaseWarmup(domain, warmupDay)
+			q.updateRecipient(campaign.ID, subscriber.ID, "pending", mail.Reply(err))
+			continue
 		}
+
+		q.updateRecipient(campaign.ID, subscriber.ID, "sent", response)
+		q.recordDeliveryEvent(campaign.ID, subscriber.ID, "delivered", response)
 	}
 
+	if deferred > 0 {
+		return fmt.Errorf("%d of %d recipients deferred: %w", deferred, len(p.Recipients), lastErr)
+	}
+	if !warmupResume.IsZero() {
+		logrus.Infof("Campaign %d: warm-up allowance of %s used up for today, resuming at %s",
+			campaign.ID, domain.Domain, warmupResume.Format(time.RFC3339))
+		return Snooze(time.Until(warmupResume))
+	}
+	if throttled > 0 {
+		logrus.Infof("Campaign %d: %d of %d recipients throttled, resuming in %s", campaign.ID, throttled, len(p.Recipients), throttleDelay)
+		return Snooze(throttleDelay)
+	}
 	return nil
 }
 
+// deliver renders the campaign for one subscriber, signs it with domain's
+// DKIM key if there is one, and sends it. It returns the SMTP reply; 5xx
+// rejections are returned as permanent errors. Cancelling ctx, e.g. on
+// shutdown, aborts the SMTP transaction.
+func (q *Queue) deliver(ctx context.Context, campaign *store.Campaign, subscriber *store.Subscriber, domain *store.Domain) (string, error) {
+	msg := q.mail.CreateCampaignMessage(campaign, subscriber, domain)
+	response, err := q.mail.Send(ctx, msg)
+	if err != nil {
+		if mail.IsPermanent(err) {
+			return "", Permanent(err)
+		}
+		return "", err
+	}
+	return response, nil
+}
+
+// sendingDomain returns the configured domain of the campaign's From
+// address, or nil if there is none, in which case mail goes out unsigned.
+func (q *Queue) sendingDomain(campaign *store.Campaign) (*store.Domain, error) {
+	name := campaign.FromEmail[strings.LastIndex(campaign.FromEmail, "@")+1:]
+	domain, err := q.db.GetDomainByName(name)
+	if err == sql.ErrNoRows {
+		logrus.Warnf("No domain configured for %s, sending campaign %d without DKIM", name, campaign.ID)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sending domain %s: %w", name, err)
+	}
+	return domain, nil
+}
+
+// recordDeliveryEvent records a delivered or failed event carrying the SMTP
+// reply.
+func (q *Queue) recordDeliveryEvent(campaignID, subscriberID int, eventType, response string) {
+	meta, _ := json.Marshal(map[string]string{"smtp_response": response})
+	if err := q.db.RecordEvent(campaignID, subscriberID, eventType, meta); err != nil {
+		logrus.Errorf("Failed to record %s event: %v", eventType, err)
+	}
+}
+
+// unsendableReason explains why subscriber must not be mailed, or returns
+// "" if it may.
+func (q *Queue) unsendableReason(subscriber *store.Subscriber) (string, error) {
+	if subscriber.Status != "active" {
+		return "subscriber is " + subscriber.Status, nil
+	}
+
+	suppressed, err := q.db.IsSuppressed(subscriber.Email)
+	if err != nil {
+		return "", fmt.Errorf("failed to check suppression for %s: %w", subscriber.Email, err)
+	}
+	if suppressed {
+		return "address is suppressed", nil
+	}
+	return "", nil
+}
+
+// skipRecipient handles a recipient that could not be claimed. One left
+// sending belongs to an earlier attempt at this batch that was interrupted
+// mid-send; since it may or may not have been delivered it is marked failed
+// rather than risk mailing it twice.
+func (q *Queue) skipRecipient(campaignID int, subscriber *store.Subscriber) {
+	recipient, err := q.db.GetCampaignRecipient(campaignID, subscriber.ID)
+	if err != nil {
+		logrus.Errorf("Failed to get recipient %s of campaign %d: %v", subscriber.Email, campaignID, err)
+		return
+	}
+	if recipient.Status != "sending" {
+		return
+	}
+
+	logrus.Warnf("Recipient %s of campaign %d was interrupted while sending, not retrying", subscriber.Email, campaignID)
+	q.updateRecipient(campaignID, subscriber.ID, "failed", "interrupted: delivery unknown")
+}
+
+// releaseRecipient puts a claimed recipient back to pending when the batch
+// gives up before attempting delivery.
+func (q *Queue) releaseRecipient(campaignID, subscriberID int) {
+	q.updateRecipient(campaignID, subscriberID, "pending", "")
+}
+
+func (q *Queue) updateRecipient(campaignID, subscriberID int, status, response string) {
+	if err := q.db.UpdateCampaignRecipient(campaignID, subscriberID, status, response); err != nil {
+		logrus.Errorf("Failed to mark recipient %d of campaign %d as %s: %v", subscriberID, campaignID, status, err)
+	}
+}
+
 func (q *Queue) BounceProcessingHandler(ctx context.Context, payload json.RawMessage) error {
 	var p BounceProcessingPayload
 	if err := json.Unmarshal(payload, &p); err != nil {
@@ -198,13 +749,20 @@ func (q *Queue) BounceProcessingHandler(ctx context.Context, payload json.RawMes
 	return nil
 }
 
-func (q *Queue) DKIMRotationHandler(ctx context.Context, payload json.RawMessage) error {
-	var p DKIMRotationPayload
+func (q *Queue) CleanupJobsHandler(ctx context.Context, payload json.RawMessage) error {
+	var p CleanupJobsPayload
 	if err := json.Unmarshal(payload, &p); err != nil {
-		return fmt.Errorf("failed to unmarshal DKIM rotation payload: %w", err)
+		return fmt.Errorf("failed to unmarshal cleanup jobs payload: %w", err)
+	}
+	if p.OlderThanDays <= 0 {
+		p.OlderThanDays = 30
+	}
+
+	deleted, err := q.db.DeleteFinishedJobs(time.Now().AddDate(0, 0, -p.OlderThanDays))
+	if err != nil {
+		return fmt.Errorf("failed to delete finished jobs: %w", err)
 	}
 
-	// TODO: Implement DKIM key rotation
-	logrus.Infof("DKIM rotation for domain %d not implemented", p.DomainID)
+	logrus.Infof("Deleted %d finished jobs older than %d days", deleted, p.OlderThanDays)
 	return nil
 }
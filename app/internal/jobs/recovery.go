@@ -0,0 +1,113 @@
+package jobs
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"newsletter/internal/store"
+	"github.com/sirupsen/logrus"
+)
+
+// RecoverOrphanedJobs re-queues jobs left running by a previous process.
+// It must be called before RunWorkers: on startup no worker of this instance
+// is running yet, so any running job locked under our own instance name (the
+// same hostname and pid, as happens with pid 1 in a restarted container) was
+// interrupted. Jobs whose lease has already expired are recovered as well.
+func (q *Queue) RecoverOrphanedJobs() (int, error) {
+	return q.recoverJobs(true)
+}
+
+// RecoverStuckJobs re-queues or fails running jobs whose lease expired or
+// that were never leased, e.g. because their worker crashed or hung.
+func (q *Queue) RecoverStuckJobs() (int, error) {
+	return q.recoverJobs(false)
+}
+
+// RunReaper periodically recovers stuck jobs until ctx is cancelled.
+func (q *Queue) RunReaper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := q.RecoverStuckJobs(); err != nil {
+				logrus.Errorf("Failed to recover stuck jobs: %v", err)
+			}
+		}
+	}
+}
+
+func (q *Queue) recoverJobs(startup bool) (int, error) {
+	jobs, err := q.db.GetRunningJobs()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get running jobs: %w", err)
+	}
+
+	now := time.Now()
+	recovered := 0
+	for _, job := range jobs {
+		reason, leaseCheck := q.recoveryReason(job, now, startup)
+		if reason == "" {
+			continue
+		}
+
+		status := "queued"
+		if job.Attempts+1 >= q.policyFor(job.Type).MaxAttempts {
+			status = "failed"
+		}
+
+		err := q.db.RecoverJob(job, status, now, leaseCheck)
+		if err == store.ErrLeaseLost {
+			// Finished, heartbeated or recovered by someone else meanwhile
+			continue
+		}
+		if err != nil {
+			logrus.Errorf("Failed to recover job %d: %v", job.ID, err)
+			continue
+		}
+
+		recovered++
+		if status == "queued" {
+			q.notify(job.Queue)
+		}
+		if err := q.db.RecordJobError(job.ID, job.Attempts+1, job.LockedBy, "recovered: "+reason); err != nil {
+			logrus.Errorf("Failed to record error for job %d: %v", job.ID, err)
+		}
+		logrus.Warnf("Recovered %s job %d (attempt %d) as %s: %s",
+			job.Type, job.ID, job.Attempts+1, status, reason)
+		if status == "failed" {
+			q.finished(job, status)
+		}
+	}
+
+	return recovered, nil
+}
+
+// recoveryReason explains why job should be recovered, or returns "" if it
+// is healthy. The boolean reports whether recovery must re-check that the
+// lease is still expired.
+func (q *Queue) recoveryReason(job *store.Job, now time.Time, startup bool) (string, bool) {
+	if startup && strings.HasPrefix(job.LockedBy, q.instance+"/") {
+		return fmt.Sprintf("orphaned by previous process %s", job.LockedBy), false
+	}
+
+	if job.LockedBy == "" || job.LeaseExpiresAt == nil {
+		return "running without a lease holder", true
+	}
+
+	if job.LeaseExpiresAt.Before(now) {
+		lastSeen := "never"
+		if job.HeartbeatAt != nil {
+			lastSeen = job.HeartbeatAt.Format(time.RFC3339)
+		}
+		return fmt.Sprintf("lease held by %s expired at %s (last heartbeat %s)",
+			job.LockedBy, job.LeaseExpiresAt.Format(time.RFC3339), lastSeen), true
+	}
+
+	return "", false
+}
@@ -0,0 +1,114 @@
+package jobs
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy controls how a failed job of a given type is retried. It is
+// registered together with the job's handler via Queue.Register.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of runs, including the first one,
+	// before the job is moved to the dead-letter queue
+	MaxAttempts int
+	// BaseDelay is the wait after the first failure; it doubles with each
+	// further failure up to MaxDelay, or up to maxBackoff if MaxDelay is 0
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Jitter is the fraction (0-1) of each delay that is randomised, so jobs
+	// that failed together do not all retry at the same instant
+	Jitter float64
+	// NonRetryable optionally classifies errors that will never succeed on
+	// retry. Errors wrapped with Permanent are always non-retryable.
+	NonRetryable func(err error) bool
+}
+
+// DefaultRetryPolicy applies to job types registered without a policy.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   time.Minute,
+	MaxDelay:    time.Hour,
+	Jitter:      0.2,
+}
+
+// maxBackoff bounds the delay of policies without a MaxDelay, and keeps
+// the doubling from overflowing.
+const maxBackoff = 7 * 24 * time.Hour
+
+// Backoff returns the delay before the next run of a job that has now
+// failed attempt times.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	limit := maxBackoff
+	if p.MaxDelay > 0 && p.MaxDelay < limit {
+		limit = p.MaxDelay
+	}
+
+	delay := p.BaseDelay
+	for i := 1; i < attempt && delay < limit; i++ {
+		delay *= 2
+	}
+	if delay > limit {
+		delay = limit
+	}
+
+	if p.Jitter > 0 {
+		delay -= time.Duration(rand.Float64() * p.Jitter * float64(delay))
+	}
+	return delay
+}
+
+// Retryable reports whether err is worth another attempt.
+func (p RetryPolicy) Retryable(err error) bool {
+	if IsPermanent(err) {
+		return false
+	}
+	if p.NonRetryable != nil && p.NonRetryable(err) {
+		return false
+	}
+	return true
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as non-retryable: the job goes straight to the
+// dead-letter queue regardless of its remaining attempts.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent reports whether err was wrapped with Permanent.
+func IsPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+type snoozeError struct {
+	delay time.Duration
+}
+
+func (e *snoozeError) Error() string { return "snoozed for " + e.delay.String() }
+
+// Snooze is returned by a handler that is waiting on something outside the
+// queue, e.g. a DNS change. The job runs again after delay without counting
+// an attempt or recording an error.
+func Snooze(delay time.Duration) error {
+	return &snoozeError{delay: delay}
+}
+
+// snoozeDuration reports whether err is a Snooze and for how long.
+func snoozeDuration(err error) (time.Duration, bool) {
+	var s *snoozeError
+	if errors.As(err, &s) {
+		return s.delay, true
+	}
+	return 0, false
+}
@@ -0,0 +1,64 @@
+package jobs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy RetryPolicy
+		want   []time.Duration // by attempt, from 1
+	}{
+		{
+			name:   "capped",
+			policy: RetryPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second},
+			want:   []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second},
+		},
+		{
+			name:   "uncapped",
+			policy: RetryPolicy{BaseDelay: time.Second},
+			want:   []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second},
+		},
+		{
+			name:   "cap below base",
+			policy: RetryPolicy{BaseDelay: time.Minute, MaxDelay: time.Second},
+			want:   []time.Duration{time.Second, time.Second},
+		},
+	}
+
+	for _, tt := range tests {
+		for i, want := range tt.want {
+			if got := tt.policy.Backoff(i + 1); got != want {
+				t.Errorf("%s: Backoff(%d) = %s, want %s", tt.name, i+1, got, want)
+			}
+		}
+	}
+}
+
+func TestBackoffDoesNotOverflow(t *testing.T) {
+	p := RetryPolicy{BaseDelay: time.Second}
+	for _, attempt := range []int{40, 64, 1000} {
+		if got := p.Backoff(attempt); got != maxBackoff {
+			t.Errorf("Backoff(%d) = %s, want %s", attempt, got, maxBackoff)
+		}
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	for _, p := range []RetryPolicy{
+		{BaseDelay: time.Second, MaxDelay: time.Minute, Jitter: 0.2},
+		{BaseDelay: time.Second, Jitter: 0.2},
+	} {
+		for attempt := 1; attempt <= 8; attempt++ {
+			full := RetryPolicy{BaseDelay: p.BaseDelay, MaxDelay: p.MaxDelay}.Backoff(attempt)
+			min := full - time.Duration(p.Jitter*float64(full))
+			for i := 0; i < 200; i++ {
+				if got := p.Backoff(attempt); got < min || got > full {
+					t.Fatalf("MaxDelay %s: Backoff(%d) = %s, want within [%s, %s]", p.MaxDelay, attempt, got, min, full)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"newsletter/internal/store"
+	"github.com/sirupsen/logrus"
+)
+
+// schedulerPollInterval caps how long the scheduler sleeps, so schedules
+// created or edited through the API (possibly on another instance) are
+// picked up promptly.
+const schedulerPollInterval = 30 * time.Second
+
+// Scheduler enqueues jobs for the recurring schedules stored in the
+// schedules table.
+type Scheduler struct {
+	queue *Queue
+	db    *store.Store
+}
+
+func NewScheduler(queue *Queue) *Scheduler {
+	return &Scheduler{queue: queue, db: queue.db}
+}
+
+// Ensure creates a schedule if none with that name exists yet. It is meant
+// for built-in schedules; once created, the schedule is managed via the API.
+func (s *Scheduler) Ensure(name, cronExpr, jobType string, payload interface{}) error {
+	cron, err := ParseCron(cronExpr)
+	if err != nil {
+		return err
+	}
+	next := cron.Next(time.Now())
+	if next.IsZero() {
+		return fmt.Errorf("cron expression %q never fires", cronExpr)
+	}
+
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal payload: %w", err)
+	}
+
+	return s.db.EnsureSchedule(&store.Schedule{
+		Name:      name,
+		CronExpr:  cronExpr,
+		JobType:   jobType,
+		Payload:   payloadBytes,
+		Enabled:   true,
+		NextRunAt: next,
+	})
+}
+
+// Run fires due schedules until ctx is cancelled.
+func (s *Scheduler) Run(ctx context.Context) {
+	logrus.Info("Starting scheduler")
+
+	for {
+		if _, err := s.RunDue(time.Now()); err != nil {
+			logrus.Errorf("Failed to run due schedules: %v", err)
+		}
+
+		wait := schedulerPollInterval
+		next, err := s.db.NextScheduleRunAt()
+		if err == nil {
+			if d := time.Until(next); d < wait {
+				wait = d
+			}
+		} else if err != sql.ErrNoRows {
+			logrus.Errorf("Failed to get next schedule time: %v", err)
+		}
+		if wait < time.Second {
+			wait = time.Second
+		}
+
+		select {
+		case <-ctx.Done():
+			logrus.Info("Stopping scheduler")
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// RunDue enqueues one job for every schedule due at now and advances each
+// schedule to its next occurrence. Occurrences missed while no instance was
+// running are collapsed into a single catch-up run.
+func (s *Scheduler) RunDue(now time.Time) (int, error) {
+	due, err := s.db.GetDueSchedules(now)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get due schedules: %w", err)
+	}
+
+	fired := 0
+	for _, schedule := range due {
+		// A schedule that cannot fire again would stay due forever, so it
+		// is disabled until it is fixed through the API
+		cron, err := ParseCron(schedule.CronExpr)
+		if err != nil {
+			s.disable(schedule, fmt.Sprintf("invalid cron expression: %v", err))
+			continue
+		}
+
+		next := cron.Next(now)
+		if next.IsZero() {
+			s.disable(schedule, "no future occurrence")
+			continue
+		}
+
+		job := s.queue.newJob(schedule.JobType, schedule.Payload, schedule.NextRunAt)
+		ok, err := s.db.FireSchedule(schedule, job, next)
+		if err != nil {
+			logrus.Errorf("Failed to fire schedule %s: %v", schedule.Name, err)
+			continue
+		}
+		if !ok {
+			// Another instance fired this occurrence, or it was edited
+			continue
+		}
+
+		fired++
+		s.queue.notify(job.Queue)
+		logrus.Infof("Schedule %s enqueued %s job %d, next run at %s",
+			schedule.Name, schedule.JobType, job.ID, next.Format(time.RFC3339))
+	}
+
+	return fired, nil
+}
+
+func (s *Scheduler) disable(schedule *store.Schedule, reason string) {
+	schedule.Enabled = false
+	if err := s.db.UpdateSchedule(schedule); err != nil {
+		logrus.Errorf("Failed to disable schedule %s (%s): %v", schedule.Name, reason, err)
+		return
+	}
+	logrus.Errorf("Disabled schedule %s: %s", schedule.Name, reason)
+}
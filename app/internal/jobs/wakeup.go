@@ -0,0 +1,64 @@
+package jobs
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// idlePollInterval bounds how long an idle worker sleeps. In-process
+	// enqueues wake workers immediately; the poll only matters for jobs
+	// added by other server processes sharing the database.
+	idlePollInterval = 30 * time.Second
+	// minIdleWait avoids spinning when a job is due but was claimed by
+	// another worker between our claim and the next-run lookup
+	minIdleWait = 250 * time.Millisecond
+)
+
+// wakeChan returns the wakeup channel for a named queue. The channel has a
+// buffer of one, so any number of notifications while workers are busy
+// collapse into a single pending wakeup.
+func (q *Queue) wakeChan(queueName string) chan struct{} {
+	q.wakeMu.Lock()
+	defer q.wakeMu.Unlock()
+
+	ch, ok := q.wake[queueName]
+	if !ok {
+		ch = make(chan struct{}, 1)
+		q.wake[queueName] = ch
+	}
+	return ch
+}
+
+// notify wakes one idle worker of queueName, if any, so it re-checks for due
+// jobs and recomputes how long to sleep.
+func (q *Queue) notify(queueName string) {
+	select {
+	case q.wakeChan(queueName) <- struct{}{}:
+	default:
+	}
+}
+
+// idleWait returns how long a worker of queueName with nothing to claim
+// should sleep: until the next queued job's run_at, capped at
+// idlePollInterval.
+func (q *Queue) idleWait(queueName string) time.Duration {
+	next, err := q.db.NextJobRunAt(queueName)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logrus.Errorf("Failed to get next run time for queue %s: %v", queueName, err)
+		}
+		return idlePollInterval
+	}
+
+	wait := time.Until(next)
+	if wait < minIdleWait {
+		return minIdleWait
+	}
+	if wait > idlePollInterval {
+		return idlePollInterval
+	}
+	return wait
+}
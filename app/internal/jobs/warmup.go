@@ -0,0 +1,185 @@
+package jobs
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"newsletter/internal/store"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultWarmupSchedule is the daily volume ramp given to new sending
+// domains: roughly doubling over the first week, then growing more slowly
+// for a month.
+var DefaultWarmupSchedule = []int{
+	50, 100, 200, 400, 700, 1000, 1500,
+	2000, 3000, 4000, 5000, 6500, 8000, 10000,
+	12500, 15000, 20000, 25000, 30000, 40000, 50000,
+	60000, 75000, 90000, 110000, 130000, 160000, 200000,
+}
+
+// WarmupStatus describes where a domain is in its warm-up.
+type WarmupStatus struct {
+	DomainID  int       `json:"domain_id"`
+	Day       int       `json:"day"`
+	Days      int       `json:"days"`
+	Complete  bool      `json:"complete"`
+	Limit     int       `json:"limit,omitempty"`
+	Sent      int       `json:"sent"`
+	Remaining int       `json:"remaining,omitempty"`
+	ResetsAt  time.Time `json:"resets_at"`
+	Schedule  []int     `json:"schedule"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// warmupDay returns the UTC day (YYYY-MM-DD) of t and how many days into
+// the plan that is, counting the start day as day 1.
+func warmupDay(warmup *store.DomainWarmup, t time.Time) (string, int) {
+	start := startOfDay(warmup.StartedAt)
+	day := int(startOfDay(t).Sub(start)/(24*time.Hour)) + 1
+	return t.UTC().Format("2006-01-02"), day
+}
+
+// warmupLimit returns the message limit for a day of the plan, or false
+// once the plan is over.
+func warmupLimit(warmup *store.DomainWarmup, day int) (int, bool) {
+	if day < 1 {
+		day = 1
+	}
+	if day > len(warmup.Schedule) {
+		return 0, false
+	}
+	return warmup.Schedule[day-1], true
+}
+
+func startOfDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// WarmupStatus returns today's position in the domain's warm-up plan, or
+// sql.ErrNoRows if it has none.
+func (q *Queue) WarmupStatus(domainID int) (*WarmupStatus, error) {
+	warmup, err := q.db.GetDomainWarmup(domainID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	today, day := warmupDay(warmup, now)
+	sent, err := q.db.GetWarmupUsage(domainID, today)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get warm-up usage: %w", err)
+	}
+
+	status := &WarmupStatus{
+		DomainID:  domainID,
+		Day:       day,
+		Days:      len(warmup.Schedule),
+		Sent:      sent,
+		ResetsAt:  startOfDay(now).Add(24 * time.Hour),
+		Schedule:  warmup.Schedule,
+		StartedAt: warmup.StartedAt,
+	}
+	limit, ok := warmupLimit(warmup, day)
+	if !ok {
+		status.Complete = true
+		return status, nil
+	}
+	status.Limit = limit
+	if sent < limit {
+		status.Remaining = limit - sent
+	}
+	return status, nil
+}
+
+// consumeWarmup counts one message against the domain's warm-up limit for
+// today. It returns the day counted on, for releaseWarmup, or when the
+// limit resets if today's allowance is used up. Domains without a plan or
+// past its end are never limited.
+func (q *Queue) consumeWarmup(domain *store.Domain) (string, time.Time, error) {
+	if domain == nil {
+		return "", time.Time{}, nil
+	}
+	warmup, err := q.db.GetDomainWarmup(domain.ID)
+	if err == sql.ErrNoRows {
+		return "", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to get warm-up plan: %w", err)
+	}
+
+	now := time.Now()
+	today, day := warmupDay(warmup, now)
+	limit, ok := warmupLimit(warmup, day)
+	if !ok {
+		return "", time.Time{}, nil
+	}
+
+	consumed, err := q.db.ConsumeWarmupQuota(domain.ID, today, limit)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to count warm-up usage: %w", err)
+	}
+	if !consumed {
+		return "", startOfDay(now).Add(24 * time.Hour), nil
+	}
+	return today, time.Time{}, nil
+}
+
+// releaseWarmup gives back a message consumeWarmup counted on day.
+func (q *Queue) releaseWarmup(domain *store.Domain, day string) {
+	if day == "" {
+		return
+	}
+	if err := q.db.ReleaseWarmupQuota(domain.ID, day); err != nil {
+		logrus.Errorf("Failed to release warm-up quota of %s: %v", domain.Domain, err)
+	}
+}
+
+// warmupRunTimes spreads batches of the given sizes over the days of the
+// domain's warm-up plan: each batch runs on the first day with allowance
+// left for its first recipient, and batches beyond the plan's last day run
+// the day after it.
+func (q *Queue) warmupRunTimes(domain *store.Domain, sizes []int) ([]time.Time, error) {
+	now := time.Now()
+	times := make([]time.Time, len(sizes))
+	for i := range times {
+		times[i] = now
+	}
+	if domain == nil {
+		return times, nil
+	}
+
+	warmup, err := q.db.GetDomainWarmup(domain.ID)
+	if err == sql.ErrNoRows {
+		return times, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get warm-up plan: %w", err)
+	}
+
+	today, day := warmupDay(warmup, now)
+	sent, err := q.db.GetWarmupUsage(domain.ID, today)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get warm-up usage: %w", err)
+	}
+
+	// Allowance left on the day being filled, starting with today's
+	offset := 0
+	allowance, limited := warmupLimit(warmup, day)
+	allowance -= sent
+	for i, size := range sizes {
+		for limited && allowance <= 0 {
+			offset++
+			allowance, limited = warmupLimit(warmup, day+offset)
+		}
+		if offset > 0 {
+			times[i] = startOfDay(now).AddDate(0, 0, offset)
+		}
+		if limited {
+			allowance -= size
+		}
+	}
+	return times, nil
+}
@@ -0,0 +1,330 @@
+package mail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DKIM canonicalization algorithms (RFC 6376 section 3.4)
+const (
+	CanonSimple  = "simple"
+	CanonRelaxed = "relaxed"
+)
+
+// dkimSignedHeaders are signed, in this order, whenever they are present.
+var dkimSignedHeaders = []string{
+	"from", "sender", "reply-to", "subject", "date", "message-id", "to", "cc",
+	"mime-version", "content-type", "content-transfer-encoding",
+	"list-id", "list-unsubscribe", "list-unsubscribe-post",
+}
+
+// dkimOversignedHeaders are signed once more than they occur, so that a
+// copy added in transit (e.g. a second From) breaks the signature instead
+// of being displayed unsigned.
+var dkimOversignedHeaders = map[string]bool{
+	"from": true, "reply-to": true, "subject": true, "date": true, "to": true, "cc": true,
+	"list-unsubscribe": true, "list-unsubscribe-post": true,
+}
+
+// DKIMSigner produces DKIM-Signature header fields for one domain and
+// selector.
+type DKIMSigner struct {
+	Domain   string
+	Selector string
+	Key      crypto.Signer
+
+	// HeaderCanonicalization and BodyCanonicalization are CanonRelaxed
+	// (the default) or CanonSimple
+	HeaderCanonicalization string
+	BodyCanonicalization   string
+}
+
+// NewDKIMSigner creates a relaxed/relaxed signer from a PEM-encoded private
+// key as stored in the domains table: RSA in PKCS#1 or PKCS#8, or Ed25519 in
+// PKCS#8.
+func NewDKIMSigner(domain, selector, privateKeyPEM string) (*DKIMSigner, error) {
+	key, err := parseDKIMKey(privateKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DKIMSigner{
+		Domain:                 domain,
+		Selector:               selector,
+		Key:                    key,
+		HeaderCanonicalization: CanonRelaxed,
+		BodyCanonicalization:   CanonRelaxed,
+	}, nil
+}
+
+func parseDKIMKey(privateKeyPEM string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(privateKeyPEM))
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode DKIM private key")
+	}
+
+	if block.Type == "RSA PRIVATE KEY" {
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse DKIM private key: %w", err)
+		}
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse DKIM private key: %w", err)
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported DKIM key type %T", key)
+	}
+}
+
+// Sign returns a DKIM-Signature header field, including its trailing CRLF,
+// for message, which must be the complete message exactly as it will be
+// sent, with CRLF line endings. The field is meant to be prepended to the
+// message.
+func (d *DKIMSigner) Sign(message []byte) (string, error) {
+	algorithm, hash, err := d.algorithm()
+	if err != nil {
+		return "", err
+	}
+
+	headerCanon, bodyCanon := d.canonicalizations()
+	header, body := splitMessage(message)
+	fields := parseHeaderFields(header)
+
+	bodyHash := sha256.Sum256(canonicalizeBody(body, bodyCanon))
+	names := signedHeaderNames(fields)
+
+	// The signature covers the DKIM-Signature field itself with an empty
+	// b= tag, which is why b= has to come last
+	value := fmt.Sprintf("v=1; a=%s; c=%s/%s; d=%s; s=%s; t=%d;\r\n\th=%s;\r\n\tbh=%s;\r\n\tb=",
+		algorithm, headerCanon, bodyCanon, d.Domain, d.Selector, time.Now().Unix(),
+		strings.Join(names, ":"), base64.StdEncoding.EncodeToString(bodyHash[:]))
+
+	h := sha256.New()
+	for _, field := range selectHeaderFields(fields, names) {
+		h.Write([]byte(canonicalizeHeader(field, headerCanon)))
+	}
+	sigField := canonicalizeHeader("DKIM-Signature: "+value+"\r\n", headerCanon)
+	h.Write([]byte(strings.TrimSuffix(sigField, "\r\n")))
+
+	digest := h.Sum(nil)
+	signature, err := d.Key.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign message: %w", err)
+	}
+
+	return "DKIM-Signature: " + value + foldBase64(base64.StdEncoding.EncodeToString(signature)) + "\r\n", nil
+}
+
+// algorithm returns the a= tag value and signing options for the key
+func (d *DKIMSigner) algorithm() (string, crypto.SignerOpts, error) {
+	switch d.Key.(type) {
+	case *rsa.PrivateKey:
+		return "rsa-sha256", crypto.SHA256, nil
+	case ed25519.PrivateKey:
+		// RFC 8463 signs the SHA-256 digest with pure Ed25519
+		return "ed25519-sha256", crypto.Hash(0), nil
+	default:
+		return "", nil, fmt.Errorf("unsupported DKIM key type %T", d.Key)
+	}
+}
+
+func (d *DKIMSigner) canonicalizations() (string, string) {
+	headerCanon, bodyCanon := d.HeaderCanonicalization, d.BodyCanonicalization
+	if headerCanon != CanonSimple {
+		headerCanon = CanonRelaxed
+	}
+	if bodyCanon != CanonSimple {
+		bodyCanon = CanonRelaxed
+	}
+	return headerCanon, bodyCanon
+}
+
+// splitMessage splits a message into its header block, including the CRLF
+// ending the last field, and its body.
+func splitMessage(message []byte) ([]byte, []byte) {
+	if bytes.HasPrefix(message, []byte("\r\n")) {
+		return nil, message[2:]
+	}
+	if i := bytes.Index(message, []byte("\r\n\r\n")); i >= 0 {
+		return message[:i+2], message[i+4:]
+	}
+	return message, nil
+}
+
+// parseHeaderFields splits a header block into raw fields, each including
+// its continuation lines and final CRLF.
+func parseHeaderFields(header []byte) []string {
+	var fields []string
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+func fieldName(field string) string {
+	name, _, _ := strings.Cut(field, ":")
+	return strings.ToLower(strings.TrimRight(name, " \t"))
+}
+
+// signedHeaderNames builds the h= tag: every present instance of the
+// signed headers plus one extra instance of the oversigned ones.
+func signedHeaderNames(fields []string) []string {
+	counts := make(map[string]int)
+	for _, field := range fields {
+		counts[fieldName(field)]++
+	}
+
+	var names []string
+	for _, name := range dkimSignedHeaders {
+		n := counts[name]
+		if dkimOversignedHeaders[name] {
+			n++
+		}
+		for i := 0; i < n; i++ {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// selectHeaderFields picks the fields named in h= the way a verifier does:
+// repeated names take instances from the bottom of the header up, and names
+// with no instance left select nothing (RFC 6376 section 5.4.2).
+func selectHeaderFields(fields []string, names []string) []string {
+	used := make([]bool, len(fields))
+	var selected []string
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && fieldName(fields[i]) == name {
+				used[i] = true
+				selected = append(selected, fields[i])
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// canonicalizeHeader canonicalizes one raw header field (RFC 6376 section
+// 3.4.1 and 3.4.2).
+func canonicalizeHeader(field, canon string) string {
+	if canon == CanonSimple {
+		return field
+	}
+
+	name, value, _ := strings.Cut(field, ":")
+	name = strings.ToLower(strings.TrimRight(name, " \t"))
+	value = strings.ReplaceAll(value, "\r\n", "")
+	value = strings.Trim(compressWSP(value), " ")
+	return name + ":" + value + "\r\n"
+}
+
+// canonicalizeBody canonicalizes a message body (RFC 6376 section 3.4.3 and
+// 3.4.4).
+func canonicalizeBody(body []byte, canon string) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	// A body ending in CRLF leaves an empty string that is not a line
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if canon == CanonRelaxed {
+		for i, line := range lines {
+			lines[i] = strings.TrimRight(compressWSP(line), " ")
+		}
+	}
+
+	// Ignore empty lines at the end of the body
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(lines) == 0 {
+		if canon == CanonSimple {
+			return []byte("\r\n")
+		}
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// compressWSP replaces each run of spaces and tabs with a single space
+func compressWSP(s string) string {
+	var b strings.Builder
+	inWSP := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			if !inWSP {
+				b.WriteByte(' ')
+			}
+			inWSP = true
+			continue
+		}
+		inWSP = false
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// foldBase64 wraps a long base64 tag value over continuation lines
+func foldBase64(s string) string {
+	const width = 72
+	var b strings.Builder
+	for len(s) > width {
+		b.WriteString(s[:width])
+		b.WriteString("\r\n\t")
+		s = s[width:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// DKIMRecord returns the DNS TXT record publishing a PEM-encoded DKIM public
+// key, e.g. "v=DKIM1; k=rsa; p=MIIBIjANBg...".
+func DKIMRecord(publicKeyPEM string) (string, error) {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil {
+		return "", fmt.Errorf("failed to decode DKIM public key")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse DKIM public key: %w", err)
+	}
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(block.Bytes), nil
+	case ed25519.PublicKey:
+		// Ed25519 records carry the bare key, not a SubjectPublicKeyInfo
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(key), nil
+	default:
+		return "", fmt.Errorf("unsupported DKIM key type %T", key)
+	}
+}
@@ -0,0 +1,516 @@
+package mail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+
+	"newsletter/internal/store"
+)
+
+// Examples from RFC 6376 section 3.4.5
+func TestCanonicalizeHeaderRFCExample(t *testing.T) {
+	fields := parseHeaderFields([]byte("A: X\r\nB : Y\t\r\n\tZ  \r\n"))
+	if len(fields) != 2 {
+		t.Fatalf("got %d fields, want 2: %q", len(fields), fields)
+	}
+
+	var relaxed, simple string
+	for _, field := range fields {
+		relaxed += canonicalizeHeader(field, CanonRelaxed)
+		simple += canonicalizeHeader(field, CanonSimple)
+	}
+
+	if want := "a:X\r\nb:Y Z\r\n"; relaxed != want {
+		t.Errorf("relaxed = %q, want %q", relaxed, want)
+	}
+	if want := "A: X\r\nB : Y\t\r\n\tZ  \r\n"; simple != want {
+		t.Errorf("simple = %q, want %q", simple, want)
+	}
+}
+
+func TestCanonicalizeBody(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		canon string
+		want  string
+	}{
+		{"relaxed RFC example", " C \r\nD \t E\r\n\r\n\r\n", CanonRelaxed, " C\r\nD E\r\n"},
+		{"simple RFC example", " C \r\nD \t E\r\n\r\n\r\n", CanonSimple, " C \r\nD \t E\r\n"},
+		{"relaxed empty", "", CanonRelaxed, ""},
+		{"simple empty", "", CanonSimple, "\r\n"},
+		{"relaxed only blank lines", "\r\n \r\n", CanonRelaxed, ""},
+		{"simple missing final CRLF", "abc", CanonSimple, "abc\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := string(canonicalizeBody([]byte(tt.body), tt.canon))
+			if got != tt.want {
+				t.Errorf("canonicalizeBody(%q) = %q, want %q", tt.body, got, tt.want)
+			}
+		})
+	}
+}
+
+// rfc8463Message is the Ed25519 example of RFC 8463 appendix A.3, signed
+// with the key of appendix A.2
+const rfc8463Message = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+	" d=football.example.com; i=@football.example.com;\r\n" +
+	" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+	" subject : date : message-id : from : subject : date;\r\n" +
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+	" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+const (
+	rfc8463Seed      = "nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A="
+	rfc8463PublicKey = "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+)
+
+// TestRFC8463KnownAnswer checks the signer's canonicalization against a
+// signature and body hash computed elsewhere.
+func TestRFC8463KnownAnswer(t *testing.T) {
+	publicKey, err := base64.StdEncoding.DecodeString(rfc8463PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, body := splitMessage([]byte(rfc8463Message))
+	fields := parseHeaderFields(header)
+	tags := dkimTags(fields[0])
+
+	bodyHash := sha256.Sum256(canonicalizeBody(body, CanonRelaxed))
+	if got := base64.StdEncoding.EncodeToString(bodyHash[:]); got != tags["bh"] {
+		t.Errorf("body hash = %s, want %s", got, tags["bh"])
+	}
+
+	// Hash the headers the way Sign does, with the RFC's h= list
+	h := sha256.New()
+	for _, field := range selectHeaderFields(fields[1:], strings.Split(tags["h"], ":")) {
+		h.Write([]byte(canonicalizeHeader(field, CanonRelaxed)))
+	}
+	unsigned := bTag.ReplaceAllString(fields[0], "$1")
+	h.Write([]byte(strings.TrimSuffix(canonicalizeHeader(unsigned, CanonRelaxed), "\r\n")))
+
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(publicKey), h.Sum(nil), signature) {
+		t.Error("signer's header canonicalization does not reproduce the RFC 8463 signature")
+	}
+
+	// The test verifier has to accept it too
+	if err := verifyDKIM([]byte(rfc8463Message), "brisbane", ed25519.PublicKey(publicKey)); err != nil {
+		t.Errorf("verifyDKIM rejects the RFC 8463 example: %v", err)
+	}
+}
+
+// TestDKIMSignerWithRFC8463Key signs the RFC example body with the RFC key
+// and checks the result independently.
+func TestDKIMSignerWithRFC8463Key(t *testing.T) {
+	seed, err := base64.StdEncoding.DecodeString(rfc8463Seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := ed25519.NewKeyFromSeed(seed)
+	if got := base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)); got != rfc8463PublicKey {
+		t.Fatalf("public key = %s, want %s", got, rfc8463PublicKey)
+	}
+
+	_, unsigned, _ := strings.Cut(rfc8463Message, "Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n")
+	signer := &DKIMSigner{Domain: "football.example.com", Selector: "brisbane", Key: key}
+	signature, err := signer.Sign([]byte(unsigned))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bh := dkimTags(signature)["bh"]; bh != "2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=" {
+		t.Errorf("bh = %s, want the RFC 8463 body hash", bh)
+	}
+	if err := verifyDKIM([]byte(signature+unsigned), "brisbane", key.Public()); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+}
+
+func TestSignedHeaderNamesOversigns(t *testing.T) {
+	fields := parseHeaderFields([]byte("From: a@example.com\r\nTo: b@example.com\r\nX-Custom: 1\r\nMIME-Version: 1.0\r\n"))
+	got := strings.Join(signedHeaderNames(fields), ":")
+	want := "from:from:reply-to:subject:date:to:to:cc:mime-version:list-unsubscribe:list-unsubscribe-post"
+	if got != want {
+		t.Errorf("h = %s, want %s", got, want)
+	}
+}
+
+func TestDKIMSignatureVerifies(t *testing.T) {
+	keyTypes := []struct {
+		name     string
+		generate func() (string, string, error)
+	}{
+		{"rsa", GenerateDKIMKeys},
+		{"ed25519", GenerateEd25519DKIMKeys},
+	}
+
+	for _, kt := range keyTypes {
+		for _, canon := range []string{CanonRelaxed, CanonSimple} {
+			t.Run(kt.name+"/"+canon, func(t *testing.T) {
+				signed, publicKey := signTestMessageWith(t, kt.generate, canon)
+				if err := verifyDKIM(signed, "test", publicKey); err != nil {
+					t.Fatalf("signature does not verify: %v\n%s", err, signed)
+				}
+			})
+		}
+	}
+}
+
+func TestDualDKIMSignatures(t *testing.T) {
+	rsaPrivate, rsaPublic, err := GenerateDKIMKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPrivate, edPublic, err := GenerateEd25519DKIMKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := testMessage()
+	msg.DKIMDomain = "example.com"
+	msg.DKIMSelector = "rsa"
+	msg.DKIMKey = rsaPrivate
+	msg.DKIMEd25519Selector = "ed"
+	msg.DKIMEd25519Key = edPrivate
+
+	signed, err := NewService().buildMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bytes.Count(signed, []byte("DKIM-Signature:")); n != 2 {
+		t.Fatalf("got %d DKIM-Signature fields, want 2", n)
+	}
+
+	if err := verifyDKIM(signed, "rsa", parsePublicKey(t, rsaPublic)); err != nil {
+		t.Errorf("RSA signature does not verify: %v", err)
+	}
+	if err := verifyDKIM(signed, "ed", parsePublicKey(t, edPublic)); err != nil {
+		t.Errorf("Ed25519 signature does not verify: %v", err)
+	}
+}
+
+func TestDKIMSignerAcceptsPKCS8RSAKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := NewDKIMSigner("example.com", "test", string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := signer.Key.(*rsa.PrivateKey); !ok {
+		t.Fatalf("got key type %T, want *rsa.PrivateKey", signer.Key)
+	}
+}
+
+func TestDKIMRecord(t *testing.T) {
+	_, rsaPublic, err := GenerateDKIMKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := DKIMRecord(rsaPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(record, "v=DKIM1; k=rsa; p=MII") {
+		t.Errorf("unexpected RSA record %q", record)
+	}
+
+	_, edPublic, err := GenerateEd25519DKIMKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err = DKIMRecord(edPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := strings.TrimPrefix(record, "v=DKIM1; k=ed25519; p=")
+	key, err := base64.StdEncoding.DecodeString(p)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		t.Errorf("Ed25519 record %q does not carry a bare 32 byte key", record)
+	}
+}
+
+func TestDKIMSignatureDetectsTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(msg []byte) []byte
+	}{
+		{"body changed", func(msg []byte) []byte {
+			return bytes.Replace(msg, []byte("Hello"), []byte("Howdy"), 1)
+		}},
+		{"subject changed", func(msg []byte) []byte {
+			return bytes.Replace(msg, []byte("Subject: Test campaign"), []byte("Subject: Urgent"), 1)
+		}},
+		{"second From added", func(msg []byte) []byte {
+			return append([]byte("From: attacker@example.net\r\n"), msg...)
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signed, publicKey := signTestMessageWith(t, GenerateDKIMKeys, CanonRelaxed)
+			tampered := tt.tamper(signed)
+			if bytes.Equal(tampered, signed) {
+				t.Fatal("tampering did not change the message")
+			}
+			if err := verifyDKIM(tampered, "test", publicKey); err == nil {
+				t.Fatal("tampered message still verifies")
+			}
+		})
+	}
+}
+
+func TestDKIMSignatureToleratesRelaxedChanges(t *testing.T) {
+	signed, publicKey := signTestMessageWith(t, GenerateDKIMKeys, CanonRelaxed)
+
+	// Whitespace changes and refolding, as relays sometimes do
+	changed := bytes.Replace(signed, []byte("Subject: Test campaign"), []byte("subject:  Test\r\n  campaign "), 1)
+	if err := verifyDKIM(changed, "test", publicKey); err != nil {
+		t.Fatalf("relaxed signature broke on whitespace change: %v", err)
+	}
+}
+
+func testMessage() *Message {
+	campaign := &store.Campaign{
+		ID:        1,
+		Subject:   "Test campaign",
+		HTML:      "<p>Hello  {{email}}</p>",
+		Text:      "Hello  {{email}}\n\n",
+		FromName:  "Newsletter",
+		FromEmail: "news@example.com",
+	}
+	return NewService().CreateCampaignMessage(campaign, &store.Subscriber{ID: 2, Email: "reader@example.org"}, nil)
+}
+
+// signTestMessageWith builds a campaign message the way Send does, signs it
+// with a fresh key from generate, and returns it with the public key.
+func signTestMessageWith(t *testing.T, generate func() (string, string, error), canon string) ([]byte, crypto.PublicKey) {
+	t.Helper()
+
+	privatePEM, publicPEM, err := generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Serialize without a key, then sign with the requested canonicalization
+	data, err := NewService().buildMessage(testMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewDKIMSigner("example.com", "test", privatePEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer.HeaderCanonicalization = canon
+	signer.BodyCanonicalization = canon
+
+	signature, err := signer.Sign(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return append([]byte(signature), data...), parsePublicKey(t, publicPEM)
+}
+
+func parsePublicKey(t *testing.T, publicPEM string) crypto.PublicKey {
+	t.Helper()
+
+	block, _ := pem.Decode([]byte(publicPEM))
+	if block == nil {
+		t.Fatal("invalid public key PEM")
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return publicKey
+}
+
+// bTag matches the value of the b= tag, which is treated as empty when
+// computing the header hash
+var bTag = regexp.MustCompile(`([;\s]b=)[^;]*`)
+
+// verifyDKIM checks the DKIM-Signature of msg made with selector against
+// publicKey as a receiver would. It deliberately shares no code with the
+// signer, so that a canonicalization bug cannot sign and verify alike.
+func verifyDKIM(msg []byte, selector string, publicKey crypto.PublicKey) error {
+	header, body, ok := strings.Cut(string(msg), "\r\n\r\n")
+	if !ok {
+		return fmt.Errorf("message has no body")
+	}
+	fields := refHeaderFields(header + "\r\n")
+
+	var sigField string
+	var tags map[string]string
+	for _, field := range fields {
+		if strings.EqualFold(refFieldName(field), "dkim-signature") {
+			if t := dkimTags(field); t["s"] == selector {
+				sigField, tags = field, t
+				break
+			}
+		}
+	}
+	if sigField == "" {
+		return fmt.Errorf("no DKIM-Signature for selector %s", selector)
+	}
+
+	headerCanon, bodyCanon, _ := strings.Cut(tags["c"], "/")
+	if bodyCanon == "" {
+		bodyCanon = CanonSimple
+	}
+
+	bodyHash := sha256.Sum256([]byte(refCanonicalizeBody(body, bodyCanon)))
+	if got := base64.StdEncoding.EncodeToString(bodyHash[:]); got != tags["bh"] {
+		return fmt.Errorf("body hash mismatch: got %s, signed %s", got, tags["bh"])
+	}
+
+	// Repeated names select instances from the bottom up; names without an
+	// instance left select nothing
+	instances := make(map[string][]string)
+	for _, field := range fields {
+		name := strings.ToLower(refFieldName(field))
+		instances[name] = append(instances[name], field)
+	}
+	h := sha256.New()
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.ToLower(name)
+		list := instances[name]
+		if len(list) == 0 {
+			continue
+		}
+		h.Write([]byte(refCanonicalizeHeader(list[len(list)-1], headerCanon)))
+		instances[name] = list[:len(list)-1]
+	}
+	unsigned := bTag.ReplaceAllString(sigField, "$1")
+	h.Write([]byte(strings.TrimSuffix(refCanonicalizeHeader(unsigned, headerCanon), "\r\n")))
+
+	signature, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %w", err)
+	}
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		if tags["a"] != "rsa-sha256" {
+			return fmt.Errorf("unexpected algorithm %q for RSA key", tags["a"])
+		}
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, h.Sum(nil), signature)
+	case ed25519.PublicKey:
+		if tags["a"] != "ed25519-sha256" {
+			return fmt.Errorf("unexpected algorithm %q for Ed25519 key", tags["a"])
+		}
+		if !ed25519.Verify(key, h.Sum(nil), signature) {
+			return fmt.Errorf("Ed25519 signature mismatch")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported key type %T", publicKey)
+	}
+}
+
+// refHeaderFields splits a header block, ending in CRLF, into raw fields
+// with their continuation lines and final CRLF
+func refHeaderFields(header string) []string {
+	lines := strings.SplitAfter(header, "\r\n")
+	var fields []string
+	for _, line := range lines {
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t"):
+			fields[len(fields)-1] += line
+		default:
+			fields = append(fields, line)
+		}
+	}
+	return fields
+}
+
+func refFieldName(field string) string {
+	return strings.TrimRight(field[:strings.Index(field, ":")], " \t")
+}
+
+var (
+	wspRun      = regexp.MustCompile(`[ \t]+`)
+	trailingWSP = regexp.MustCompile(`[ \t]+\r\n`)
+)
+
+// refCanonicalizeHeader implements RFC 6376 section 3.4.1 and 3.4.2
+func refCanonicalizeHeader(field, canon string) string {
+	if canon == CanonSimple {
+		return field
+	}
+	colon := strings.Index(field, ":")
+	name := strings.ToLower(strings.TrimRight(field[:colon], " \t"))
+	value := strings.NewReplacer("\r\n ", " ", "\r\n\t", "\t").Replace(field[colon+1:])
+	value = strings.TrimSuffix(value, "\r\n")
+	value = strings.TrimSpace(wspRun.ReplaceAllString(value, " "))
+	return name + ":" + value + "\r\n"
+}
+
+// refCanonicalizeBody implements RFC 6376 section 3.4.3 and 3.4.4
+func refCanonicalizeBody(body, canon string) string {
+	if body != "" && !strings.HasSuffix(body, "\r\n") {
+		body += "\r\n"
+	}
+	if canon == CanonRelaxed {
+		body = trailingWSP.ReplaceAllString(body, "\r\n")
+		body = wspRun.ReplaceAllString(body, " ")
+	}
+	for strings.HasSuffix(body, "\r\n\r\n") {
+		body = strings.TrimSuffix(body, "\r\n")
+	}
+	if body == "\r\n" {
+		body = ""
+	}
+	if body == "" && canon == CanonSimple {
+		return "\r\n"
+	}
+	return body
+}
+
+func dkimTags(field string) map[string]string {
+	tags := make(map[string]string)
+	_, value, _ := strings.Cut(field, ":")
+	for _, tag := range strings.Split(value, ";") {
+		name, v, ok := strings.Cut(tag, "=")
+		if !ok {
+			continue
+		}
+		tags[strings.TrimSpace(name)] = strings.Join(strings.Fields(v), "")
+	}
+	return tags
+}
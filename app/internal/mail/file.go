@@ -0,0 +1,69 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// FileTransport writes messages to a directory instead of delivering them,
+// for staging and tests. In Maildir mode the directory is a Maildir that
+// any mail client can open; otherwise each message is a .eml file.
+type FileTransport struct {
+	Dir     string
+	Maildir bool
+}
+
+var fileSeq atomic.Uint64
+
+func NewFileTransport(dir string, maildir bool) (*FileTransport, error) {
+	subdirs := []string{""}
+	if maildir {
+		subdirs = []string{"tmp", "new", "cur"}
+	}
+	for _, sub := range subdirs {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create mail directory: %w", err)
+		}
+	}
+	return &FileTransport{Dir: dir, Maildir: maildir}, nil
+}
+
+// Send stores the message with the envelope recorded in Return-Path and
+// Delivered-To fields, as a local delivery would.
+func (t *FileTransport) Send(ctx context.Context, env Envelope, data []byte) (string, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Return-Path: <%s>\r\n", env.From)
+	for _, to := range env.To {
+		fmt.Fprintf(&buf, "Delivered-To: %s\r\n", to)
+	}
+	buf.Write(data)
+
+	host, _ := os.Hostname()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", time.Now().Unix(), time.Now().Nanosecond()/1000, os.Getpid(), fileSeq.Add(1), host)
+
+	// Maildir readers never see a partial message: it is written to tmp and
+	// then moved into new. Maildir messages use local line endings
+	if t.Maildir {
+		tmp := filepath.Join(t.Dir, "tmp", name)
+		message := bytes.ReplaceAll(buf.Bytes(), []byte("\r\n"), []byte("\n"))
+		if err := os.WriteFile(tmp, message, 0o644); err != nil {
+			return "", fmt.Errorf("failed to write message: %w", err)
+		}
+		if err := os.Rename(tmp, filepath.Join(t.Dir, "new", name)); err != nil {
+			os.Remove(tmp)
+			return "", fmt.Errorf("failed to deliver message: %w", err)
+		}
+		return "250 stored as " + name, nil
+	}
+
+	name += ".eml"
+	if err := os.WriteFile(filepath.Join(t.Dir, name), buf.Bytes(), 0o644); err != nil {
+		return "", fmt.Errorf("failed to write message: %w", err)
+	}
+	return "250 stored as " + name, nil
+}
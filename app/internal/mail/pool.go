@@ -0,0 +1,222 @@
+package mail
+
+import (
+	"context"
+	"net"
+	"net/smtp"
+	"sync"
+	"time"
+)
+
+// SMTP connection pool defaults
+const (
+	DefaultSMTPMaxConns           = 10
+	DefaultSMTPMaxMessagesPerConn = 100
+	DefaultSMTPIdleTimeout        = 30 * time.Second
+)
+
+// PoolStats describes an SMTP transport's connection pool.
+type PoolStats struct {
+	Idle     int   `json:"idle"`
+	InUse    int   `json:"in_use"`
+	Dials    int64 `json:"dials"`
+	Reused   int64 `json:"reused"`
+	Messages int64 `json:"messages"`
+	Errors   int64 `json:"errors"`
+	Resets   int64 `json:"resets"`
+	Closed   int64 `json:"closed"`
+}
+
+type smtpConn struct {
+	conn     net.Conn
+	client   *smtp.Client
+	messages int
+	lastUsed time.Time
+	started  bool
+}
+
+type smtpPool struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	idle   []*smtpConn
+	inUse  int
+	closed bool
+	stats  PoolStats
+}
+
+// get returns an idle connection, or dials a new one if there is none,
+// waiting while MaxConns connections are in use or until ctx is done.
+func (t *SMTPTransport) get(ctx context.Context) (*smtpConn, bool, error) {
+	p := &t.pool
+	p.mu.Lock()
+	if p.cond == nil {
+		p.cond = sync.NewCond(&p.mu)
+	}
+	if t.MaxConns > 0 && p.inUse >= t.MaxConns {
+		// Wake the waiters when ctx is done so this one can give up
+		stop := context.AfterFunc(ctx, func() {
+			p.mu.Lock()
+			p.cond.Broadcast()
+			p.mu.Unlock()
+		})
+		defer stop()
+		for p.inUse >= t.MaxConns {
+			if err := ctx.Err(); err != nil {
+				// Pass on a wakeup from put this waiter may have taken
+				p.cond.Signal()
+				p.mu.Unlock()
+				return nil, false, err
+			}
+			p.cond.Wait()
+		}
+	}
+	p.inUse++
+
+	var stale []*smtpConn
+	var c *smtpConn
+	for c == nil && len(p.idle) > 0 {
+		c = p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if t.IdleTimeout > 0 && time.Since(c.lastUsed) > t.IdleTimeout {
+			stale = append(stale, c)
+			c = nil
+		}
+	}
+	if c != nil {
+		p.stats.Reused++
+	}
+	p.stats.Closed += int64(len(stale))
+	p.mu.Unlock()
+
+	for _, s := range stale {
+		s.close()
+	}
+	if c != nil {
+		return c, true, nil
+	}
+
+	c, err := t.dialCounted(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	return c, false, nil
+}
+
+// getFresh replaces a connection that was just given back with a newly
+// dialed one.
+func (t *SMTPTransport) getFresh(ctx context.Context) (*smtpConn, bool, error) {
+	p := &t.pool
+	p.mu.Lock()
+	p.inUse++
+	p.mu.Unlock()
+
+	c, err := t.dialCounted(ctx)
+	return c, false, err
+}
+
+func (t *SMTPTransport) dialCounted(ctx context.Context) (*smtpConn, error) {
+	c, err := t.dial(ctx)
+
+	p := &t.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.stats.Errors++
+		p.inUse--
+		p.cond.Signal()
+		return nil, err
+	}
+	p.stats.Dials++
+	return c, nil
+}
+
+// put gives a connection back after a transaction that ended with err. A
+// connection stays pooled after a successful transaction or an SMTP error
+// reply, once RSET has cleared the failed transaction; it is closed after
+// a connection error or once it has carried MaxMessagesPerConn messages.
+func (t *SMTPTransport) put(c *smtpConn, err error) {
+	c.messages++
+	keep := true
+	if err != nil {
+		keep = isReply(err) && c.client.Reset() == nil
+	}
+
+	p := &t.pool
+	p.mu.Lock()
+	p.inUse--
+	p.cond.Signal()
+	if err == nil {
+		p.stats.Messages++
+	} else {
+		p.stats.Errors++
+		if keep {
+			p.stats.Resets++
+		}
+	}
+	if keep && !p.closed && (t.MaxMessagesPerConn <= 0 || c.messages < t.MaxMessagesPerConn) {
+		c.lastUsed = time.Now()
+		p.idle = append(p.idle, c)
+		p.mu.Unlock()
+		return
+	}
+	p.stats.Closed++
+	p.mu.Unlock()
+
+	if keep {
+		c.quit()
+	} else {
+		c.close()
+	}
+}
+
+// Ping checks that the relay accepts connections and credentials, using a
+// new connection so the pool is left alone.
+func (t *SMTPTransport) Ping(ctx context.Context) error {
+	c, err := t.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.quit()
+	return c.client.Noop()
+}
+
+// Stats returns a snapshot of the pool.
+func (t *SMTPTransport) Stats() PoolStats {
+	p := &t.pool
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := p.stats
+	stats.Idle = len(p.idle)
+	stats.InUse = p.inUse
+	return stats
+}
+
+// Close says goodbye on the idle connections. Connections in use are
+// closed as they are given back.
+func (t *SMTPTransport) Close() error {
+	p := &t.pool
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.stats.Closed += int64(len(idle))
+	p.mu.Unlock()
+
+	for _, c := range idle {
+		c.quit()
+	}
+	return nil
+}
+
+// quit ends the session politely; the server has accepted every message
+// sent on it, so a failing QUIT changes nothing.
+func (c *smtpConn) quit() {
+	c.conn.SetDeadline(time.Now().Add(smtpDialTimeout))
+	c.client.Quit()
+	c.client.Close()
+}
+
+func (c *smtpConn) close() {
+	c.client.Close()
+}
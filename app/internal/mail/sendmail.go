@@ -0,0 +1,70 @@
+package mail
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// DefaultSendmailPath is where sendmail-compatible MTAs install their
+// submission program.
+const DefaultSendmailPath = "/usr/sbin/sendmail"
+
+// sysexits(3) codes sendmail uses for messages that will never be accepted.
+// Everything else, notably EX_TEMPFAIL (75), is worth retrying.
+var sendmailPermanentExits = map[int]bool{
+	64: true, // EX_USAGE
+	65: true, // EX_DATAERR
+	67: true, // EX_NOUSER
+	68: true, // EX_NOHOST
+	77: true, // EX_NOPERM
+}
+
+// SendmailTransport pipes messages to a local sendmail program, leaving
+// queueing and delivery to the local MTA.
+type SendmailTransport struct {
+	Path string
+}
+
+func NewSendmailTransport(path string) *SendmailTransport {
+	if path == "" {
+		path = DefaultSendmailPath
+	}
+	return &SendmailTransport{Path: path}
+}
+
+// Send runs sendmail with the envelope on its command line and the message
+// on stdin. sendmail is killed if ctx is done before it exits.
+func (t *SendmailTransport) Send(ctx context.Context, env Envelope, data []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+
+	// -i keeps a lone "." line from ending the message; recipients follow
+	// "--" so an address can never be taken for an option
+	args := []string{"-i", "-f", env.From, "--"}
+	cmd := exec.CommandContext(ctx, t.Path, append(args, env.To...)...)
+	// sendmail expects local line endings
+	cmd.Stdin = bytes.NewReader(bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n")))
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(output.String()); msg != "" {
+			err = fmt.Errorf("%s: %w: %s", t.Path, err, msg)
+		} else {
+			err = fmt.Errorf("%s: %w", t.Path, err)
+		}
+
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && sendmailPermanentExits[exitErr.ExitCode()] {
+			return "", rejected(err)
+		}
+		return "", err
+	}
+
+	return "sendmail: accepted for delivery", nil
+}
@@ -1,33 +1,53 @@
 package mail
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
-	"net/smtp"
+	htmlstd "html"
+	"net"
+	"net/url"
+	"regexp"
 	"strings"
 
 	"github.com/jordan-wright/email"
-	"github.com/sirupsen/logrus"
 	"newsletter/internal/store"
+	"newsletter/internal/tracking"
 )
 
 type Service struct {
-	SMTPHost     string
-	SMTPPort     string
-	SMTPUsername string
-	SMTPPassword string
+	// Transport delivers built messages; it defaults to an SMTP relay on
+	// localhost
+	Transport Transport
+	// Throttle limits campaign sending rates; nil means unlimited
+	Throttle *Throttle
+	// Tracking signs the open pixel, click-tracking and unsubscribe links;
+	// without it campaign mail is not tracked and cannot be unsubscribed
+	// from
+	Tracking *tracking.Signer
+	// BaseURL is the public URL of the server, without a trailing slash,
+	// that tracking and unsubscribe links point to
+	BaseURL string
+	// UnsubscribeMailbox is the local part of the List-Unsubscribe mailto:
+	// address at the sending domain; the recipient's token is appended
+	// after a "+"
+	UnsubscribeMailbox string
 }
 
+// DefaultUnsubscribeMailbox is the default UnsubscribeMailbox
+const DefaultUnsubscribeMailbox = "unsubscribe"
+
 func NewService() *Service {
 	return &Service{
-		SMTPHost:     "localhost",
-		SMTPPort:     "587",
-		SMTPUsername: "",
-		SMTPPassword: "",
+		Transport:          NewSMTPTransport("localhost", "587", "", "", TLSStartTLS),
+		BaseURL:            "http://localhost:8080",
+		UnsubscribeMailbox: DefaultUnsubscribeMailbox,
 	}
 }
 
@@ -43,9 +63,34 @@ type Message struct {
 	DKIMDomain  string
 	DKIMKey     string
 	DKIMSelector string
+	// Optional Ed25519 key, signed in addition to DKIMKey
+	DKIMEd25519Key      string
+	DKIMEd25519Selector string
+	// CampaignID is set for campaign mail and used for relay routing
+	CampaignID int
+	// BaseURL overrides the service's BaseURL in the message's links
+	BaseURL string
+	// UnsubscribeURL and UnsubscribeMailto are the recipient's signed
+	// List-Unsubscribe targets; the header is left out without them
+	UnsubscribeURL    string
+	UnsubscribeMailto string
+}
+
+// Send delivers msg through the service's transport and returns its reply
+// to the message, e.g. "250 2.0.0 Ok: queued as 4F2A9". Use IsPermanent to
+// tell a rejection from a temporary failure.
+func (s *Service) Send(ctx context.Context, msg *Message) (string, error) {
+	data, err := s.buildMessage(msg)
+	if err != nil {
+		return "", err
+	}
+
+	return s.Transport.Send(ctx, Envelope{From: msg.From, To: msg.To, CampaignID: msg.CampaignID}, data)
 }
 
-func (s *Service) Send(msg *Message) error {
+// buildMessage serializes msg and, if a DKIM key is set, signs exactly the
+// bytes that will be sent.
+func (s *Service) buildMessage(msg *Message) ([]byte, error) {
 	e := email.NewEmail()
 	e.From = fmt.Sprintf("%s <%s>", msg.FromName, msg.From)
 	e.To = msg.To
@@ -62,90 +107,67 @@ func (s *Service) Send(msg *Message) error {
 		e.Headers.Set(key, value)
 	}
 
-	// Add DKIM signature if provided
-	if msg.DKIMDomain != "" && msg.DKIMKey != "" && msg.DKIMSelector != "" {
-		if err := s.addDKIMSignature(e, msg); err != nil {
-			logrus.Warnf("Failed to add DKIM signature: %v", err)
-		}
+	// Add List-Unsubscribe header (RFC 2369). One-click unsubscribe (RFC
+	// 8058) is only offered for an HTTPS URL
+	var unsubscribe []string
+	if msg.UnsubscribeURL != "" {
+		unsubscribe = append(unsubscribe, "<"+msg.UnsubscribeURL+">")
 	}
-
-	// Add List-Unsubscribe header
-	unsubscribeURL := fmt.Sprintf("https://%s/u/%%recipient_id%%/%%unsubscribe_token%%", msg.DKIMDomain)
-	e.Headers.Set("List-Unsubscribe", fmt.Sprintf("<%s>", unsubscribeURL))
-	e.Headers.Set("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
-
-	// Send email
-	addr := fmt.Sprintf("%s:%s", s.SMTPHost, s.SMTPPort)
-	auth := smtp.PlainAuth("", s.SMTPUsername, s.SMTPPassword, s.SMTPHost)
-	
-	return e.Send(addr, auth)
-}
-
-func (s *Service) addDKIMSignature(e *email.Email, msg *Message) error {
-	// Parse private key
-	block, _ := pem.Decode([]byte(msg.DKIMKey))
-	if block == nil {
-		return fmt.Errorf("failed to decode DKIM private key")
+	if msg.UnsubscribeMailto != "" {
+		unsubscribe = append(unsubscribe, "<mailto:"+msg.UnsubscribeMailto+"?subject=unsubscribe>")
+	}
+	if len(unsubscribe) > 0 {
+		e.Headers.Set("List-Unsubscribe", strings.Join(unsubscribe, ", "))
+	}
+	if strings.HasPrefix(msg.UnsubscribeURL, "https://") {
+		e.Headers.Set("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
 	}
 
-	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	// Serialize once: Bytes picks a new MIME boundary on every call
+	data, err := e.Bytes()
 	if err != nil {
-		return fmt.Errorf("failed to parse DKIM private key: %w", err)
+		return nil, fmt.Errorf("failed to build message: %w", err)
 	}
+	data = toCRLF(data)
 
-	// Create DKIM signature
-	signature := s.createDKIMSignature(e, msg.DKIMDomain, msg.DKIMSelector, privateKey)
-	
-	// Add DKIM-Signature header
-	e.Headers.Set("DKIM-Signature", signature)
-	
-	return nil
-}
-
-func (s *Service) createDKIMSignature(e *email.Email, domain, selector string, privateKey *rsa.PrivateKey) string {
-	// This is a simplified DKIM implementation
-	// In production, you'd want to use a proper DKIM library
-	
-	// Convert MIMEHeader to map[string]string
-	headers := make(map[string]string)
-	for k, v := range e.Headers {
-		if len(v) > 0 {
-			headers[k] = v[0]
+	// Add DKIM signatures if provided. Each one covers the unsigned
+	// message, so receivers can check either independently. Mail only goes
+	// out unsigned without a key: with a broken one it would fail DKIM and
+	// DMARC at every receiver
+	var signatures []byte
+	if msg.DKIMKey != "" {
+		signature, err := signDKIM(data, msg.DKIMDomain, msg.DKIMSelector, msg.DKIMKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add DKIM signature: %w", err)
 		}
+		signatures = append(signatures, signature...)
 	}
-	
-	canonicalizedHeaders := s.canonicalizeHeaders(headers)
-	canonicalizedBody := s.canonicalizeBody(e.Text)
-	
-	// Create the signature data (using canonicalized data in real implementation)
-	signatureData := fmt.Sprintf("v=1; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s; h=%s; bh=%s; b=",
-		domain, selector, "from:to:subject:date:message-id", "dummy-hash")
-	
-	// In a real implementation, you'd sign the canonicalized data
-	// For now, we'll return a placeholder signature
-	_ = canonicalizedHeaders // Use variable to avoid "declared and not used" error
-	_ = canonicalizedBody     // Use variable to avoid "declared and not used" error
-	return signatureData + "dummy-signature"
+	if msg.DKIMEd25519Key != "" {
+		signature, err := signDKIM(data, msg.DKIMDomain, msg.DKIMEd25519Selector, msg.DKIMEd25519Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add Ed25519 DKIM signature: %w", err)
+		}
+		signatures = append(signatures, signature...)
+	}
+
+	return append(signatures, data...), nil
 }
 
-func (s *Service) canonicalizeHeaders(headers map[string]string) string {
-	// Simplified header canonicalization
-	var result []string
-	for key, value := range headers {
-		result = append(result, fmt.Sprintf("%s: %s", strings.ToLower(key), strings.TrimSpace(value)))
+func signDKIM(data []byte, domain, selector, privateKeyPEM string) (string, error) {
+	if domain == "" || selector == "" {
+		return "", fmt.Errorf("DKIM key has no domain or selector")
+	}
+	signer, err := NewDKIMSigner(domain, selector, privateKeyPEM)
+	if err != nil {
+		return "", err
 	}
-	return strings.Join(result, "\r\n")
+	return signer.Sign(data)
 }
 
-func (s *Service) canonicalizeBody(body []byte) string {
-	// Simplified body canonicalization
-	bodyStr := string(body)
-	// Remove trailing whitespace from each line
-	lines := strings.Split(bodyStr, "\n")
-	for i, line := range lines {
-		lines[i] = strings.TrimRight(line, " \t")
-	}
-	return strings.Join(lines, "\n")
+// toCRLF converts bare LF line endings to CRLF, as they will be on the wire
+func toCRLF(data []byte) []byte {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
 }
 
 func GenerateDKIMKeys() (privateKey, publicKey string, err error) {
@@ -175,6 +197,35 @@ func GenerateDKIMKeys() (privateKey, publicKey string, err error) {
 	return string(privateKeyPEM), string(publicKeyPEM), nil
 }
 
+// GenerateEd25519DKIMKeys generates an Ed25519 DKIM key pair (RFC 8463) as
+// PKCS#8 and PKIX PEM blocks.
+func GenerateEd25519DKIMKeys() (privateKey, publicKey string, err error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate Ed25519 key: %w", err)
+	}
+
+	privateKeyDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to marshal private key: %w", err)
+	}
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "PRIVATE KEY",
+		Bytes: privateKeyDER,
+	})
+
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to marshal public key: %w", err)
+	}
+	publicKeyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: publicKeyDER,
+	})
+
+	return string(privateKeyPEM), string(publicKeyPEM), nil
+}
+
 func (s *Service) CreateTestMessage(campaignID int, subscriberID int, to string) *Message {
 	return &Message{
 		To:       []string{to},
@@ -191,35 +242,110 @@ func (s *Service) CreateTestMessage(campaignID int, subscriberID int, to string)
 	}
 }
 
-func (s *Service) CreateCampaignMessage(campaign *store.Campaign, subscriber *store.Subscriber) *Message {
+// CreateCampaignMessage renders campaign for subscriber. If domain, the
+// campaign's sending domain, is set the message is DKIM-signed with its keys
+// and its links use the domain's tracking host.
+func (s *Service) CreateCampaignMessage(campaign *store.Campaign, subscriber *store.Subscriber, domain *store.Domain) *Message {
+	baseURL := s.LinkBaseURL(domain)
+
 	// Replace placeholders in HTML and text
-	html := s.replacePlaceholders(campaign.HTML, subscriber)
-	text := s.replacePlaceholders(campaign.Text, subscriber)
+	unsubscribeURL := s.UnsubscribeURL(baseURL, campaign.ID, subscriber.ID)
+	html := s.replacePlaceholders(campaign.HTML, subscriber, unsubscribeURL)
+	text := s.replacePlaceholders(campaign.Text, subscriber, unsubscribeURL)
 
 	// Add tracking pixels and links
-	html = s.addTracking(html, campaign.ID, subscriber.ID)
+	html = s.addTracking(html, campaign.ID, subscriber.ID, baseURL)
 
-	return &Message{
-		To:       []string{subscriber.Email},
-		From:     campaign.FromEmail,
-		FromName: campaign.FromName,
-		Subject:  campaign.Subject,
-		HTML:     html,
-		Text:     text,
-		ReplyTo:  campaign.ReplyTo,
+	msg := &Message{
+		To:         []string{subscriber.Email},
+		From:       campaign.FromEmail,
+		FromName:   campaign.FromName,
+		Subject:    campaign.Subject,
+		HTML:       html,
+		Text:       text,
+		ReplyTo:    campaign.ReplyTo,
+		CampaignID: campaign.ID,
 		Headers: map[string]string{
 			"X-Campaign-ID":      fmt.Sprintf("%d", campaign.ID),
 			"X-Subscriber-ID":    fmt.Sprintf("%d", subscriber.ID),
 			"X-Mailer":           "Newsletter Platform",
 			"Message-ID":         fmt.Sprintf("<%d.%d@newsletter.local>", campaign.ID, subscriber.ID),
 		},
+		BaseURL:        baseURL,
+		UnsubscribeURL: unsubscribeURL,
+	}
+	if s.Tracking != nil {
+		senderDomain := campaign.FromEmail[strings.LastIndex(campaign.FromEmail, "@")+1:]
+		if domain != nil {
+			senderDomain = domain.Domain
+		}
+		msg.UnsubscribeMailto = s.UnsubscribeAddress(senderDomain, campaign.ID, subscriber.ID)
+	}
+	if domain != nil {
+		msg.DKIMDomain = domain.Domain
+		msg.DKIMKey = domain.DKIMPrivateKey
+		msg.DKIMSelector = domain.DKIMSelector
+		msg.DKIMEd25519Key = domain.DKIMEd25519PrivateKey
+		msg.DKIMEd25519Selector = domain.DKIMEd25519Selector
+	}
+	return msg
+}
+
+// LinkBaseURL returns the base URL of links in mail sent from domain: the
+// service's BaseURL with the host name replaced by the domain's tracking
+// host, if it has one, so that links align with the sending domain. Scheme
+// and port are kept, so with https the tracking host needs a certificate.
+func (s *Service) LinkBaseURL(domain *store.Domain) string {
+	if domain == nil || domain.TrackingHost == "" {
+		return s.BaseURL
+	}
+	u, err := url.Parse(s.BaseURL)
+	if err != nil {
+		return s.BaseURL
+	}
+	if port := u.Port(); port != "" {
+		u.Host = net.JoinHostPort(domain.TrackingHost, port)
+	} else {
+		u.Host = domain.TrackingHost
+	}
+	return u.String()
+}
+
+// UnsubscribeURL returns the signed unsubscribe link of a subscriber under
+// baseURL. campaignID is 0 outside of campaigns.
+func (s *Service) UnsubscribeURL(baseURL string, campaignID, subscriberID int) string {
+	token := ""
+	if s.Tracking != nil {
+		token = s.Tracking.UnsubscribeToken(tracking.Unsubscribe{CampaignID: campaignID, SubscriberID: subscriberID})
+	}
+	return fmt.Sprintf("%s/u/%d/%s", baseURL, subscriberID, token)
+}
+
+// UnsubscribeAddress returns the signed mailto: unsubscribe address of a
+// subscriber at domain, e.g. unsubscribe+aevkp4ks...@news.example.com.
+func (s *Service) UnsubscribeAddress(domain string, campaignID, subscriberID int) string {
+	token := s.Tracking.UnsubscribeAddressToken(tracking.Unsubscribe{CampaignID: campaignID, SubscriberID: subscriberID})
+	return s.UnsubscribeMailbox + "+" + token + "@" + domain
+}
+
+// UnsubscribeTokenFromAddress returns the token of an address from
+// UnsubscribeAddress, or "" if addr is not one.
+func (s *Service) UnsubscribeTokenFromAddress(addr string) string {
+	local, _, ok := strings.Cut(addr, "@")
+	if !ok {
+		return ""
+	}
+	mailbox, token, ok := strings.Cut(local, "+")
+	if !ok || !strings.EqualFold(mailbox, s.UnsubscribeMailbox) {
+		return ""
 	}
+	return token
 }
 
-func (s *Service) replacePlaceholders(content string, subscriber *store.Subscriber) string {
+func (s *Service) replacePlaceholders(content string, subscriber *store.Subscriber, unsubscribeURL string) string {
 	// Replace common placeholders
 	content = strings.ReplaceAll(content, "{{email}}", subscriber.Email)
-	content = strings.ReplaceAll(content, "{{unsubscribe_url}}", fmt.Sprintf("https://example.com/u/%d/token", subscriber.ID))
+	content = strings.ReplaceAll(content, "{{unsubscribe_url}}", unsubscribeURL)
 	
 	// Replace custom attributes
 	if subscriber.Attributes != nil {
@@ -235,9 +361,14 @@ func (s *Service) replacePlaceholders(content string, subscriber *store.Subscrib
 	return content
 }
 
-func (s *Service) addTracking(html string, campaignID, subscriberID int) string {
+func (s *Service) addTracking(html string, campaignID, subscriberID int, baseURL string) string {
+	if s.Tracking == nil {
+		return html
+	}
+
 	// Add open tracking pixel
-	trackingPixel := fmt.Sprintf(`<img src="https://example.com/api/track/open?c=%d&s=%d" width="1" height="1" style="display:none;">`, campaignID, subscriberID)
+	token := s.Tracking.OpenToken(tracking.Open{CampaignID: campaignID, SubscriberID: subscriberID})
+	trackingPixel := fmt.Sprintf(`<img src="%s/o/%s" width="1" height="1" alt="" style="display:none;">`, baseURL, token)
 	
 	// Add before closing body tag
 	if strings.Contains(html, "</body>") {
@@ -246,8 +377,45 @@ func (s *Service) addTracking(html string, campaignID, subscriberID int) string
 		html += trackingPixel
 	}
 	
-	// TODO: Add click tracking for links
-	// This would involve wrapping all links with tracking URLs
-	
-	return html
+	return s.rewriteLinks(html, campaignID, subscriberID, baseURL)
+}
+
+// linkPattern matches the href attribute of an <a> tag, capturing what
+// precedes the URL and the URL in double or single quotes
+var linkPattern = regexp.MustCompile(`(?is)(<a\s[^>]*?\bhref\s*=\s*)(?:"([^"]*)"|'([^']*)')`)
+
+// isUnsubscribeLink reports whether u is one of our own unsubscribe links
+// under base. Links to /u/ paths on other hosts are ordinary links.
+func isUnsubscribeLink(u, base *url.URL) bool {
+	return base != nil && strings.EqualFold(u.Host, base.Host) && strings.HasPrefix(u.Path, base.Path+"/u/")
+}
+
+// rewriteLinks points every http(s) link at a signed /l/{token} redirect
+// that records the click. Unsubscribe links are left alone, as are mailto:
+// links and in-page anchors.
+func (s *Service) rewriteLinks(html string, campaignID, subscriberID int, baseURL string) string {
+	base, _ := url.Parse(baseURL)
+
+	index := 0
+	return linkPattern.ReplaceAllStringFunc(html, func(tag string) string {
+		m := linkPattern.FindStringSubmatch(tag)
+		quote, href := `"`, m[2]
+		if strings.HasSuffix(tag, "'") {
+			quote, href = "'", m[3]
+		}
+		target := strings.TrimSpace(htmlstd.UnescapeString(href))
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || isUnsubscribeLink(u, base) {
+			return tag
+		}
+
+		token := s.Tracking.ClickToken(tracking.Click{
+			CampaignID:   campaignID,
+			SubscriberID: subscriberID,
+			Index:        index,
+			URL:          target,
+		})
+		index++
+		return m[1] + quote + baseURL + "/l/" + token + quote
+	})
 }
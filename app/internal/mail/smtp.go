@@ -0,0 +1,249 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"time"
+)
+
+const (
+	smtpDialTimeout = 30 * time.Second
+	// smtpTimeout bounds a whole SMTP conversation for one message
+	smtpTimeout = 5 * time.Minute
+)
+
+// SMTP TLS modes
+const (
+	// TLSStartTLS upgrades the connection with STARTTLS if the server
+	// offers it, and requires it before authenticating
+	TLSStartTLS = "starttls"
+	// TLSImplicit connects over TLS from the start (submissions, port 465)
+	TLSImplicit = "tls"
+	// TLSNone never uses TLS, e.g. for a relay on the same host
+	TLSNone = "none"
+)
+
+// SMTPTransport submits messages to an SMTP relay. Connections are pooled
+// and carry many transactions each, so a batch pays the TCP, TLS and AUTH
+// handshakes once per connection rather than once per recipient.
+type SMTPTransport struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	// TLS is TLSStartTLS (the default), TLSImplicit or TLSNone
+	TLS string
+
+	// MaxConns caps the open connections; Send waits for a free one
+	// beyond that. MaxMessagesPerConn retires a connection after that many
+	// messages, and IdleTimeout drops connections unused for that long.
+	MaxConns           int
+	MaxMessagesPerConn int
+	IdleTimeout        time.Duration
+
+	pool smtpPool
+}
+
+func NewSMTPTransport(host, port, username, password, tlsMode string) *SMTPTransport {
+	return &SMTPTransport{
+		Host:               host,
+		Port:               port,
+		Username:           username,
+		Password:           password,
+		TLS:                tlsMode,
+		MaxConns:           DefaultSMTPMaxConns,
+		MaxMessagesPerConn: DefaultSMTPMaxMessagesPerConn,
+		IdleTimeout:        DefaultSMTPIdleTimeout,
+	}
+}
+
+// Send runs one SMTP transaction on a pooled connection. Unlike
+// smtp.SendMail it returns the server's reply to the message data, which
+// usually carries the queue ID. Replies rejecting the message are returned
+// as *textproto.Error. ctx bounds the wait for a connection, the dial and
+// the transaction.
+func (t *SMTPTransport) Send(ctx context.Context, env Envelope, data []byte) (string, error) {
+	c, reused, err := t.get(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	reply, err := c.send(ctx, env, data)
+	if err != nil && reused && !c.started && !isReply(err) && ctx.Err() == nil {
+		// The server may have dropped the connection while it sat idle;
+		// nothing was sent yet, so try once more on a fresh one
+		t.put(c, err)
+		if c, _, err = t.getFresh(ctx); err != nil {
+			return "", err
+		}
+		reply, err = c.send(ctx, env, data)
+	}
+
+	t.put(c, err)
+	return reply, err
+}
+
+// send runs one MAIL/RCPT/DATA transaction. started is set once the
+// transaction got past MAIL FROM. If ctx is done first the transaction is
+// cut short, which leaves the connection broken.
+func (c *smtpConn) send(ctx context.Context, env Envelope, data []byte) (string, error) {
+	c.started = false
+	c.conn.SetDeadline(deadline(ctx))
+	stop := interruptOnDone(ctx, c.conn)
+	defer stop()
+
+	reply, err := c.transact(env, data)
+	if err != nil && !isReply(err) && ctx.Err() != nil {
+		return "", fmt.Errorf("SMTP transaction interrupted: %w", ctx.Err())
+	}
+	return reply, err
+}
+
+func (c *smtpConn) transact(env Envelope, data []byte) (string, error) {
+	if err := c.client.Mail(env.From); err != nil {
+		return "", err
+	}
+	c.started = true
+	for _, rcpt := range env.To {
+		if err := c.client.Rcpt(rcpt); err != nil {
+			return "", err
+		}
+	}
+
+	return writeData(c.client.Text, data)
+}
+
+// deadline returns when an SMTP exchange starting now must be over: after
+// smtpTimeout, or at ctx's deadline if that comes first.
+func deadline(ctx context.Context) time.Time {
+	d := time.Now().Add(smtpTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(d) {
+		return ctxDeadline
+	}
+	return d
+}
+
+// interruptOnDone unblocks reads and writes on conn once ctx is done. The
+// returned func stops watching ctx.
+func interruptOnDone(ctx context.Context, conn net.Conn) func() bool {
+	return context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+}
+
+// dial opens, secures and authenticates a new connection to the relay.
+func (t *SMTPTransport) dial(ctx context.Context) (*smtpConn, error) {
+	addr := net.JoinHostPort(t.Host, t.Port)
+	tlsConfig := &tls.Config{ServerName: t.Host}
+
+	dialer := &net.Dialer{Timeout: smtpDialTimeout}
+	var conn net.Conn
+	var err error
+	if t.TLS == TLSImplicit {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+	conn.SetDeadline(deadline(ctx))
+	stop := interruptOnDone(ctx, conn)
+	defer stop()
+
+	c, err := smtp.NewClient(conn, t.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if t.TLS != TLSImplicit && t.TLS != TLSNone {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				c.Close()
+				return nil, fmt.Errorf("failed to start TLS: %w", err)
+			}
+		} else if t.Username != "" {
+			// Never send credentials in the clear
+			c.Close()
+			return nil, fmt.Errorf("%s does not offer STARTTLS, refusing to authenticate", addr)
+		}
+	}
+
+	// Relaying without the configured credentials would either be rejected
+	// later or, worse, accepted by the wrong server
+	if t.Username != "" {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			c.Close()
+			return nil, fmt.Errorf("%s does not support AUTH, refusing to send without authenticating", addr)
+		}
+		if err := c.Auth(smtp.PlainAuth("", t.Username, t.Password, t.Host)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return &smtpConn{conn: conn, client: c}, nil
+}
+
+// writeData sends the DATA command and message, returning the final reply.
+// smtp.Client.Data discards that reply, so the exchange is done by hand.
+func writeData(text *textproto.Conn, data []byte) (string, error) {
+	id, err := text.Cmd("DATA")
+	if err != nil {
+		return "", err
+	}
+	text.StartResponse(id)
+	_, _, err = text.ReadResponse(354)
+	text.EndResponse(id)
+	if err != nil {
+		return "", err
+	}
+
+	w := text.DotWriter()
+	if _, err := w.Write(data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	code, msg, err := text.ReadResponse(250)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d %s", code, msg), nil
+}
+
+// IsPermanent reports whether err is a 5xx SMTP reply or another permanent
+// rejection by the transport, i.e. the message will never be accepted. 4xx
+// replies and connection errors are temporary and worth retrying.
+func IsPermanent(err error) bool {
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code >= 500
+	}
+	return isRejected(err)
+}
+
+// isReply reports whether err is a reply from the server, after which the
+// session is still usable, rather than a broken connection.
+func isReply(err error) bool {
+	var smtpErr *textproto.Error
+	return errors.As(err, &smtpErr)
+}
+
+// Reply returns the SMTP reply carried by err, e.g. "550 5.1.1 User unknown",
+// or the error text if err is not an SMTP reply.
+func Reply(err error) string {
+	var smtpErr *textproto.Error
+	if errors.As(err, &smtpErr) {
+		return fmt.Sprintf("%d %s", smtpErr.Code, smtpErr.Msg)
+	}
+	return err.Error()
+}
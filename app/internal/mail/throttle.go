@@ -0,0 +1,225 @@
+package mail
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// mxCacheTTL is how long a recipient domain's MX host is remembered
+	mxCacheTTL      = time.Hour
+	mxLookupTimeout = 5 * time.Second
+)
+
+// RateLimit is a sending rate, e.g. 10 messages per second. The zero value
+// means unlimited.
+type RateLimit struct {
+	Limit rate.Limit
+	Burst int
+}
+
+// ParseRateLimit parses a rate such as "10/s", "300/m" or "5000/h". An empty
+// string is unlimited.
+func ParseRateLimit(s string) (RateLimit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return RateLimit{}, nil
+	}
+
+	count, unit, ok := strings.Cut(s, "/")
+	n, err := strconv.ParseFloat(count, 64)
+	if !ok || err != nil || n <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate %q, want e.g. 10/s", s)
+	}
+	per := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}[unit]
+	if per == 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate unit in %q, want s, m or h", s)
+	}
+
+	// Allow up to a second's worth of messages at once
+	perSecond := n / per.Seconds()
+	return RateLimit{Limit: rate.Limit(perSecond), Burst: int(math.Max(1, math.Ceil(perSecond)))}, nil
+}
+
+// ParseRateLimits parses a list such as "google.com=10/s,outlook.com=300/m".
+func ParseRateLimits(s string) (map[string]RateLimit, error) {
+	limits := make(map[string]RateLimit)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit %q, want name=rate", entry)
+		}
+		limit, err := ParseRateLimit(value)
+		if err != nil {
+			return nil, err
+		}
+		limits[strings.ToLower(strings.TrimSpace(key))] = limit
+	}
+	return limits, nil
+}
+
+// ThrottleConfig sets the sending rates. Each message has to fit the
+// global rate, the rate of its sending domain and the rate of its
+// recipient's mail provider.
+type ThrottleConfig struct {
+	Global RateLimit
+	// Domain applies to each sending domain; Domains overrides it for
+	// particular ones
+	Domain  RateLimit
+	Domains map[string]RateLimit
+	// MX applies to each recipient MX host. MXProviders overrides it for
+	// MX hosts ending in a suffix, e.g. "google.com" for Gmail, and all
+	// hosts of a provider share one limit
+	MX          RateLimit
+	MXProviders map[string]RateLimit
+}
+
+// Throttle limits the rate of outbound mail without blocking: Reserve
+// reports how long a message has to wait, and senders defer messages that
+// would wait too long instead of holding a worker.
+type Throttle struct {
+	config ThrottleConfig
+
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+	mx       map[string]mxEntry
+}
+
+// throttleKey names a limiter and its rate
+type throttleKey struct {
+	key   string
+	limit RateLimit
+}
+
+type mxEntry struct {
+	host    string
+	expires time.Time
+}
+
+func NewThrottle(config ThrottleConfig) *Throttle {
+	return &Throttle{
+		config:   config,
+		limiters: make(map[string]*rate.Limiter),
+		mx:       make(map[string]mxEntry),
+	}
+}
+
+// Reserve takes a sending slot for a message from senderDomain to
+// recipient. If the slot is at most maxWait away it is kept and Reserve
+// returns the wait and true; the caller waits that long and sends. Otherwise
+// nothing is taken and Reserve returns how long until a slot frees up and
+// false. A nil Throttle never waits.
+func (t *Throttle) Reserve(senderDomain, recipient string, maxWait time.Duration) (time.Duration, bool) {
+	if t == nil {
+		return 0, true
+	}
+
+	keys := []throttleKey{
+		{"global", t.config.Global},
+		t.domainLimit(senderDomain),
+		t.mxLimit(addressDomain(recipient)),
+	}
+
+	now := time.Now()
+	var reservations []*rate.Reservation
+	var wait time.Duration
+	for _, k := range keys {
+		if k.limit.Limit == 0 {
+			continue
+		}
+		r := t.limiter(k.key, k.limit).ReserveN(now, 1)
+		reservations = append(reservations, r)
+		if d := r.DelayFrom(now); d > wait {
+			wait = d
+		}
+	}
+
+	if wait > maxWait {
+		for _, r := range reservations {
+			r.CancelAt(now)
+		}
+		return wait, false
+	}
+	return wait, true
+}
+
+func (t *Throttle) domainLimit(domain string) throttleKey {
+	domain = strings.ToLower(domain)
+	limit, ok := t.config.Domains[domain]
+	if !ok {
+		limit = t.config.Domain
+	}
+	return throttleKey{"domain:" + domain, limit}
+}
+
+// mxLimit returns the limiter key and rate for the recipient domain's
+// primary MX host.
+func (t *Throttle) mxLimit(domain string) throttleKey {
+	host := t.mxHost(strings.ToLower(domain))
+
+	// Longest suffix first, so "eu.outlook.com" can override "outlook.com"
+	suffixes := make([]string, 0, len(t.config.MXProviders))
+	for suffix := range t.config.MXProviders {
+		suffixes = append(suffixes, suffix)
+	}
+	sort.Slice(suffixes, func(i, j int) bool { return len(suffixes[i]) > len(suffixes[j]) })
+	for _, suffix := range suffixes {
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return throttleKey{"mx:" + suffix, t.config.MXProviders[suffix]}
+		}
+	}
+	return throttleKey{"mx:" + host, t.config.MX}
+}
+
+// mxHost returns the most preferred MX host of domain, or the domain
+// itself if it has none or the lookup fails.
+func (t *Throttle) mxHost(domain string) string {
+	if t.config.MX.Limit == 0 && len(t.config.MXProviders) == 0 {
+		return domain
+	}
+
+	t.mu.Lock()
+	entry, ok := t.mx[domain]
+	t.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.host
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mxLookupTimeout)
+	defer cancel()
+	host := domain
+	if records, err := net.DefaultResolver.LookupMX(ctx, domain); err == nil && len(records) > 0 {
+		// LookupMX sorts by preference
+		host = strings.ToLower(strings.TrimSuffix(records[0].Host, "."))
+	}
+
+	t.mu.Lock()
+	t.mx[domain] = mxEntry{host: host, expires: time.Now().Add(mxCacheTTL)}
+	t.mu.Unlock()
+	return host
+}
+
+func (t *Throttle) limiter(key string, limit RateLimit) *rate.Limiter {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	l, ok := t.limiters[key]
+	if !ok {
+		l = rate.NewLimiter(limit.Limit, limit.Burst)
+		t.limiters[key] = l
+	}
+	return l
+}
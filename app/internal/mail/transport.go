@@ -0,0 +1,68 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// Envelope is the SMTP envelope of a message: the return path and the
+// recipients it is delivered to, which need not match its headers.
+type Envelope struct {
+	From string
+	To   []string
+	// CampaignID is the campaign the message belongs to, if any, for
+	// routing
+	CampaignID int
+}
+
+// Transport hands a serialized, signed message over for delivery. Send
+// returns the receiving side's reply, e.g. "250 2.0.0 Ok: queued as 4F2A9",
+// and an error that IsPermanent reports on when the message was rejected
+// for good. Send gives up when ctx is done.
+type Transport interface {
+	Send(ctx context.Context, env Envelope, data []byte) (string, error)
+}
+
+// statsReporter is implemented by transports that pool connections.
+type statsReporter interface {
+	Stats() PoolStats
+}
+
+// TransportStats returns the per-relay stats of a Router, or the
+// connection pool stats of a pooling transport.
+func (s *Service) TransportStats() (interface{}, bool) {
+	switch t := s.Transport.(type) {
+	case *Router:
+		return t.Stats(), true
+	case statsReporter:
+		return t.Stats(), true
+	}
+	return nil, false
+}
+
+// Close releases the transport's pooled connections, if it has any.
+func (s *Service) Close() error {
+	if c, ok := s.Transport.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+type rejectedError struct {
+	err error
+}
+
+func (e *rejectedError) Error() string { return e.err.Error() }
+func (e *rejectedError) Unwrap() error { return e.err }
+
+// rejected marks err as a permanent delivery failure for transports that do
+// not speak SMTP.
+func rejected(err error) error {
+	return &rejectedError{err: err}
+}
+
+func isRejected(err error) bool {
+	var r *rejectedError
+	return errors.As(err, &r)
+}
@@ -3,6 +3,7 @@ package store
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -49,6 +50,28 @@ type Campaign struct {
 	SentAt       *time.Time `json:"sent_at,omitempty"`
 }
 
+// CampaignRecipient is one subscriber's entry in a campaign's delivery
+// ledger.
+type CampaignRecipient struct {
+	CampaignID   int       `json:"campaign_id"`
+	SubscriberID int       `json:"subscriber_id"`
+	Email        string    `json:"email"`
+	Status       string    `json:"status"`
+	SMTPResponse string    `json:"smtp_response,omitempty"`
+	Attempts     int       `json:"attempts"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// RecipientFilter narrows GetCampaignRecipients. Empty fields match
+// everything.
+type RecipientFilter struct {
+	Status string
+	Email  string
+	Limit  int
+	Offset int
+}
+
 type Event struct {
 	ID           int             `json:"id"`
 	CampaignID   int             `json:"campaign_id"`
@@ -65,12 +88,67 @@ type Suppression struct {
 }
 
 type Job struct {
+	ID             int             `json:"id"`
+	Type           string          `json:"type"`
+	Queue          string          `json:"queue"`
+	Priority       int             `json:"priority"`
+	UniqueKey      string          `json:"unique_key,omitempty"`
+	CampaignID     int             `json:"campaign_id,omitempty"`
+	Payload        json.RawMessage `json:"payload"`
+	RunAt          time.Time       `json:"run_at"`
+	Attempts       int             `json:"attempts"`
+	Status         string          `json:"status"`
+	LockedBy       string          `json:"locked_by,omitempty"`
+	LeaseExpiresAt *time.Time      `json:"lease_expires_at,omitempty"`
+	HeartbeatAt    *time.Time      `json:"heartbeat_at,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+}
+
+// ErrLeaseLost is returned when a worker touches a job it no longer holds,
+// either because its lease expired and the job was recovered or because
+// another worker has claimed it since.
+var ErrLeaseLost = errors.New("job lease lost")
+
+// ErrJobNotFailed is returned when retrying or discarding a job that is not
+// in the dead-letter queue.
+var ErrJobNotFailed = errors.New("job is not in failed status")
+
+// ErrJobDuplicate is returned when retrying a failed job whose unique key
+// has since been taken by a queued or running job.
+var ErrJobDuplicate = errors.New("a job with the same unique key is already queued or running")
+
+// JobError is one failed attempt in a job's error history.
+type JobError struct {
+	ID      int       `json:"id"`
+	JobID   int       `json:"job_id"`
+	Attempt int       `json:"attempt"`
+	Worker  string    `json:"worker,omitempty"`
+	Error   string    `json:"error"`
+	At      time.Time `json:"at"`
+}
+
+// JobFilter narrows ListJobs. Empty fields match everything.
+type JobFilter struct {
+	Type   string
+	Queue  string
+	Status string
+	Limit  int
+	Offset int
+}
+
+type Schedule struct {
 	ID        int             `json:"id"`
-	Type      string          `json:"type"`
+	Name      string          `json:"name"`
+	CronExpr  string          `json:"cron_expr"`
+	JobType   string          `json:"job_type"`
 	Payload   json.RawMessage `json:"payload"`
-	RunAt     time.Time       `json:"run_at"`
-	Attempts  int             `json:"attempts"`
-	Status    string          `json:"status"`
+	Enabled   bool            `json:"enabled"`
+	NextRunAt time.Time       `json:"next_run_at"`
+	LastRunAt *time.Time      `json:"last_run_at,omitempty"`
+	LastJobID *int            `json:"last_job_id,omitempty"`
+	Version   int             `json:"-"`
 	CreatedAt time.Time       `json:"created_at"`
 	UpdatedAt time.Time       `json:"updated_at"`
 }
@@ -86,6 +164,52 @@ type Domain struct {
 	PTRRecord       string     `json:"ptr_record"`
 	VerifiedAt      *time.Time `json:"verified_at,omitempty"`
 	CreatedAt       time.Time  `json:"created_at"`
+
+	// Optional Ed25519 key (RFC 8463) signed alongside the RSA one
+	DKIMEd25519Selector   string `json:"dkim_ed25519_selector,omitempty"`
+	DKIMEd25519PrivateKey string `json:"-"`
+	DKIMEd25519PublicKey  string `json:"dkim_ed25519_public_key,omitempty"`
+
+	// Optional host, e.g. links.news.example.com, that links in the
+	// domain's mail point to instead of the server's public host
+	TrackingHost string `json:"tracking_host,omitempty"`
+}
+
+// DomainWarmup is a domain's warm-up plan: Schedule[0] messages may be sent
+// on the UTC day StartedAt falls on, Schedule[1] the next day and so on.
+// Past the end of the schedule the domain is warmed up.
+type DomainWarmup struct {
+	DomainID  int       `json:"domain_id"`
+	Schedule  []int     `json:"schedule"`
+	StartedAt time.Time `json:"started_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DomainKey is a DKIM key of a domain. A rotation creates a pending key,
+// which becomes active once its DNS record is visible; the key it replaces
+// is retiring until its grace period ends and it is retired.
+type DomainKey struct {
+	ID          int        `json:"id"`
+	DomainID    int        `json:"domain_id"`
+	Algorithm   string     `json:"algorithm"`
+	Selector    string     `json:"selector"`
+	PrivateKey  string     `json:"-"`
+	PublicKey   string     `json:"public_key"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ActivatedAt *time.Time `json:"activated_at,omitempty"`
+	RetireAt    *time.Time `json:"retire_at,omitempty"`
+	RetiredAt   *time.Time `json:"retired_at,omitempty"`
+}
+
+// DomainKeyHistory records one stage of a key's rotation.
+type DomainKeyHistory struct {
+	ID       int       `json:"id"`
+	DomainID int       `json:"domain_id"`
+	KeyID    int       `json:"key_id"`
+	Stage    string    `json:"stage"`
+	Message  string    `json:"message,omitempty"`
+	At       time.Time `json:"at"`
 }
 
 type User struct {
@@ -112,7 +236,9 @@ func Open(dsn string) (*Store, error) {
 		return nil, fmt.Errorf("failed to create database directory: %w", err)
 	}
 
-	db, err := sql.Open("sqlite3", dbPath+"?_journal_mode=WAL&_foreign_keys=1")
+	// busy_timeout lets concurrent writers (other workers or other server
+	// processes sharing the file) wait for the write lock instead of failing
+	db, err := sql.Open("sqlite3", dbPath+"?_journal_mode=WAL&_foreign_keys=1&_busy_timeout=5000")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -139,6 +265,15 @@ func (s *Store) DB() *sql.DB {
 }
 
 func Migrate(db *sql.DB) error {
+	// Track applied migrations so that non-idempotent statements
+	// (ALTER TABLE ... ADD COLUMN) only ever run once
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version TEXT PRIMARY KEY,
+		applied_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
 	// Read migration files
 	migrationDir := "migrations"
 	files, err := ioutil.ReadDir(migrationDir)
@@ -151,6 +286,15 @@ func Migrate(db *sql.DB) error {
 			continue
 		}
 
+		var applied int
+		err := db.QueryRow(`SELECT 1 FROM schema_migrations WHERE version = ?`, file.Name()).Scan(&applied)
+		if err == nil {
+			continue
+		}
+		if err != sql.ErrNoRows {
+			return fmt.Errorf("failed to check migration %s: %w", file.Name(), err)
+		}
+
 		migrationPath := filepath.Join(migrationDir, file.Name())
 		content, err := ioutil.ReadFile(migrationPath)
 		if err != nil {
@@ -158,9 +302,21 @@ func Migrate(db *sql.DB) error {
 		}
 
 		logrus.Infof("Running migration: %s", file.Name())
-		if _, err := db.Exec(string(content)); err != nil {
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin migration %s: %w", file.Name(), err)
+		}
+		if _, err := tx.Exec(string(content)); err != nil {
+			tx.Rollback()
 			return fmt.Errorf("failed to run migration %s: %w", file.Name(), err)
 		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, file.Name()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to record migration %s: %w", file.Name(), err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit migration %s: %w", file.Name(), err)
+		}
 	}
 
 	return nil
@@ -278,6 +434,46 @@ func (s *Store) GetLists() ([]*List, error) {
 	return lists, nil
 }
 
+// AddListMember adds a subscriber to a list. Adding an existing member is a
+// no-op.
+func (s *Store) AddListMember(listID, subscriberID int) error {
+	query := `INSERT OR IGNORE INTO list_members (list_id, subscriber_id) VALUES (?, ?)`
+	_, err := s.db.Exec(query, listID, subscriberID)
+	return err
+}
+
+// GetSendableListMembers returns the active, non-suppressed subscribers of a
+// list in ID order.
+func (s *Store) GetSendableListMembers(listID int) ([]*Subscriber, error) {
+	query := `SELECT s.id, s.email, s.status, s.attributes, s.created_at, s.unsubscribed_at
+			  FROM list_members m
+			  JOIN subscribers s ON s.id = m.subscriber_id
+			  WHERE m.list_id = ? AND s.status = 'active'
+			    AND NOT EXISTS (SELECT 1 FROM suppressions x WHERE x.email = s.email)
+			  ORDER BY s.id`
+	rows, err := s.db.Query(query, listID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subscribers []*Subscriber
+	for rows.Next() {
+		var sub Subscriber
+		var unsubscribedAt sql.NullTime
+		err := rows.Scan(&sub.ID, &sub.Email, &sub.Status, &sub.Attributes, &sub.CreatedAt, &unsubscribedAt)
+		if err != nil {
+			return nil, err
+		}
+		if unsubscribedAt.Valid {
+			sub.UnsubscribedAt = &unsubscribedAt.Time
+		}
+		subscribers = append(subscribers, &sub)
+	}
+
+	return subscribers, rows.Err()
+}
+
 // Campaign methods
 func (s *Store) CreateCampaign(campaign *Campaign) error {
 	query := `INSERT INTO campaigns (list_id, subject, html, text, from_name, from_email, reply_to, status, scheduled_at) 
@@ -362,6 +558,195 @@ func (s *Store) UpdateCampaignStatus(id int, status string) error {
 	return err
 }
 
+// StartCampaign moves a draft campaign to status and enqueues job, its plan,
+// in a single transaction, so a campaign never leaves draft without one.
+// Returns false if the campaign is no longer a draft.
+func (s *Store) StartCampaign(campaignID int, status string, job *Job) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE campaigns SET status = ? WHERE id = ? AND status = 'draft'`, status, campaignID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if affected == 0 {
+		return false, nil
+	}
+
+	if _, err := insertJob(tx, job); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Campaign recipient methods
+// AddCampaignRecipients adds subscribers to the campaign's ledger as
+// pending. Subscribers already in the ledger keep their state.
+func (s *Store) AddCampaignRecipients(campaignID int, subscribers []*Subscriber) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT OR IGNORE INTO campaign_recipients (campaign_id, subscriber_id, email) VALUES (?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, sub := range subscribers {
+		if _, err := stmt.Exec(campaignID, sub.ID, sub.Email); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetCampaignRecipientEmails returns the addresses in the campaign's ledger
+// in the order they were added, whatever their status.
+func (s *Store) GetCampaignRecipientEmails(campaignID int) ([]string, error) {
+	query := `SELECT email FROM campaign_recipients WHERE campaign_id = ? ORDER BY rowid`
+	rows, err := s.db.Query(query, campaignID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var emails []string
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, err
+		}
+		emails = append(emails, email)
+	}
+
+	return emails, rows.Err()
+}
+
+const recipientColumns = `campaign_id, subscriber_id, email, status, smtp_response, attempts, created_at, updated_at`
+
+func scanRecipient(row rowScanner) (*CampaignRecipient, error) {
+	var recipient CampaignRecipient
+	var response sql.NullString
+	err := row.Scan(&recipient.CampaignID, &recipient.SubscriberID, &recipient.Email, &recipient.Status,
+		&response, &recipient.Attempts, &recipient.CreatedAt, &recipient.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	recipient.SMTPResponse = response.String
+	return &recipient, nil
+}
+
+func (s *Store) GetCampaignRecipient(campaignID, subscriberID int) (*CampaignRecipient, error) {
+	query := `SELECT ` + recipientColumns + ` FROM campaign_recipients WHERE campaign_id = ? AND subscriber_id = ?`
+	return scanRecipient(s.db.QueryRow(query, campaignID, subscriberID))
+}
+
+// GetCampaignRecipients returns the campaign's ledger entries matching
+// filter in subscriber order.
+func (s *Store) GetCampaignRecipients(campaignID int, filter RecipientFilter) ([]*CampaignRecipient, error) {
+	query := `SELECT ` + recipientColumns + ` FROM campaign_recipients WHERE campaign_id = ?`
+	args := []interface{}{campaignID}
+	if filter.Status != "" {
+		query += ` AND status = ?`
+		args = append(args, filter.Status)
+	}
+	if filter.Email != "" {
+		query += ` AND email = ?`
+		args = append(args, filter.Email)
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	query += ` ORDER BY subscriber_id LIMIT ? OFFSET ?`
+	args = append(args, limit, filter.Offset)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recipients := []*CampaignRecipient{}
+	for rows.Next() {
+		recipient, err := scanRecipient(rows)
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	return recipients, rows.Err()
+}
+
+// CountCampaignRecipients counts the campaign's ledger entries by status.
+func (s *Store) CountCampaignRecipients(campaignID int) (map[string]int, error) {
+	query := `SELECT status, COUNT(*) FROM campaign_recipients WHERE campaign_id = ? GROUP BY status`
+	rows, err := s.db.Query(query, campaignID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, err
+		}
+		counts[status] = n
+	}
+
+	return counts, rows.Err()
+}
+
+// ClaimCampaignRecipient marks a pending recipient as sending and counts the
+// attempt, adding it to the ledger first if needed. It returns false if the
+// recipient is not pending, i.e. it was already sent, failed or is being
+// sent.
+func (s *Store) ClaimCampaignRecipient(campaignID, subscriberID int, email string) (bool, error) {
+	query := `INSERT INTO campaign_recipients (campaign_id, subscriber_id, email, status, attempts)
+			  VALUES (?, ?, ?, 'sending', 1)
+			  ON CONFLICT(campaign_id, subscriber_id) DO UPDATE
+			  SET status = 'sending', attempts = attempts + 1, updated_at = CURRENT_TIMESTAMP
+			  WHERE status = 'pending'`
+	result, err := s.db.Exec(query, campaignID, subscriberID, email)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// UpdateCampaignRecipient records the outcome of a delivery attempt.
+func (s *Store) UpdateCampaignRecipient(campaignID, subscriberID int, status, smtpResponse string) error {
+	query := `UPDATE campaign_recipients SET status = ?, smtp_response = ?, updated_at = CURRENT_TIMESTAMP
+			  WHERE campaign_id = ? AND subscriber_id = ?`
+	_, err := s.db.Exec(query, status, nullString(smtpResponse), campaignID, subscriberID)
+	return err
+}
+
 // Event methods
 func (s *Store) RecordEvent(campaignID, subscriberID int, eventType string, meta json.RawMessage) error {
 	query := `INSERT INTO events (campaign_id, subscriber_id, type, meta) VALUES (?, ?, ?, ?)`
@@ -369,6 +754,41 @@ func (s *Store) RecordEvent(campaignID, subscriberID int, eventType string, meta
 	return err
 }
 
+// RecordEvents inserts events in one transaction, keeping their times. An
+// event that cannot be inserted, e.g. because its campaign was deleted, is
+// skipped; the first such error is returned along with the number of
+// events recorded.
+func (s *Store) RecordEvents(events []*Event) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO events (campaign_id, subscriber_id, type, meta, at) VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+
+	recorded := 0
+	var firstErr error
+	for _, e := range events {
+		if _, err := stmt.Exec(e.CampaignID, e.SubscriberID, e.Type, []byte(e.Meta), e.At); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		recorded++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return recorded, firstErr
+}
+
 func (s *Store) GetCampaignEvents(campaignID int) ([]*Event, error) {
 	query := `SELECT id, campaign_id, subscriber_id, type, meta, at FROM events WHERE campaign_id = ? ORDER BY at DESC`
 	rows, err := s.db.Query(query, campaignID)
@@ -397,6 +817,47 @@ func (s *Store) AddSuppression(email, reason string) error {
 	return err
 }
 
+// Unsubscribe marks a subscriber unsubscribed and suppresses its address,
+// keeping the reason of an existing suppression. Only the first unsubscribe
+// records an event, for campaignID if it is set and the campaign still
+// exists. It reports whether the subscriber was still subscribed.
+func (s *Store) Unsubscribe(subscriberID, campaignID int, meta json.RawMessage) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var email string
+	if err := tx.QueryRow(`SELECT email FROM subscribers WHERE id = ?`, subscriberID).Scan(&email); err != nil {
+		return false, err
+	}
+
+	result, err := tx.Exec(`UPDATE subscribers SET status = 'unsubscribed', unsubscribed_at = ? WHERE id = ? AND status != 'unsubscribed'`,
+		time.Now(), subscriberID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO suppressions (email, reason) VALUES (?, 'unsubscribed')`, email); err != nil {
+		return false, err
+	}
+
+	if n > 0 && campaignID > 0 {
+		query := `INSERT INTO events (campaign_id, subscriber_id, type, meta)
+				  SELECT ?, ?, 'unsubscribe', ? WHERE EXISTS (SELECT 1 FROM campaigns WHERE id = ?)`
+		if _, err := tx.Exec(query, campaignID, subscriberID, meta, campaignID); err != nil {
+			return false, err
+		}
+	}
+
+	return n > 0, tx.Commit()
+}
+
 func (s *Store) IsSuppressed(email string) (bool, error) {
 	query := `SELECT 1 FROM suppressions WHERE email = ? LIMIT 1`
 	var exists int
@@ -408,104 +869,988 @@ func (s *Store) IsSuppressed(email string) (bool, error) {
 }
 
 // Job methods
-func (s *Store) EnqueueJob(jobType string, payload json.RawMessage, runAt time.Time) error {
-	query := `INSERT INTO jobs (type, payload, run_at) VALUES (?, ?, ?)`
-	_, err := s.db.Exec(query, jobType, payload, runAt)
-	return err
+// dbtx is satisfied by both *sql.DB and *sql.Tx
+type dbtx interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// EnqueueJob stores job and sets its ID. If job.UniqueKey is set and a
+// queued or running job with that key exists, nothing is inserted: job is
+// overwritten with the existing row and created is false. Keys of done and
+// failed jobs can be reused.
+func (s *Store) EnqueueJob(job *Job) (created bool, err error) {
+	return insertJob(s.db, job)
+}
+
+func insertJob(db dbtx, job *Job) (bool, error) {
+	if job.Queue == "" {
+		job.Queue = "default"
+	}
+
+	campaignID := sql.NullInt64{Int64: int64(job.CampaignID), Valid: job.CampaignID != 0}
+	query := `INSERT INTO jobs (type, queue, priority, unique_key, campaign_id, payload, run_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+			  ON CONFLICT(unique_key) WHERE unique_key IS NOT NULL AND status IN ('queued', 'running') DO NOTHING`
+	result, err := db.Exec(query, job.Type, job.Queue, job.Priority, nullString(job.UniqueKey), campaignID, []byte(job.Payload), job.RunAt)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if affected == 0 {
+		query := `SELECT ` + jobColumns + ` FROM jobs WHERE unique_key = ? AND status IN ('queued', 'running')`
+		existing, err := scanJob(db.QueryRow(query, job.UniqueKey))
+		if err != nil {
+			return false, err
+		}
+		*job = *existing
+		return false, nil
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return false, err
+	}
+
+	job.ID = int(id)
+	job.Status = "queued"
+	return true, nil
+}
+
+// GetLiveJobByKey returns the queued or running job with the unique key, or
+// sql.ErrNoRows if there is none.
+func (s *Store) GetLiveJobByKey(key string) (*Job, error) {
+	query := `SELECT ` + jobColumns + ` FROM jobs WHERE unique_key = ? AND status IN ('queued', 'running')`
+	return scanJob(s.db.QueryRow(query, key))
+}
+
+// JobKeyExists reports whether a job with the unique key exists in any
+// status.
+func (s *Store) JobKeyExists(key string) (bool, error) {
+	var exists int
+	err := s.db.QueryRow(`SELECT 1 FROM jobs WHERE unique_key = ? LIMIT 1`, key).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
 }
 
-func (s *Store) GetNextJob() (*Job, error) {
-	query := `SELECT id, type, payload, run_at, attempts, status, created_at, updated_at 
-			  FROM jobs WHERE status = 'queued' AND run_at <= ? ORDER BY run_at ASC LIMIT 1`
-	row := s.db.QueryRow(query, time.Now())
+const jobColumns = `id, type, queue, priority, unique_key, campaign_id, payload, run_at, attempts, status, locked_by, lease_expires_at, heartbeat_at, last_error, created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
 
+func scanJob(row rowScanner) (*Job, error) {
 	var job Job
-	err := row.Scan(&job.ID, &job.Type, &job.Payload, &job.RunAt, &job.Attempts, &job.Status, &job.CreatedAt, &job.UpdatedAt)
+	var uniqueKey, lockedBy, lastError sql.NullString
+	var campaignID sql.NullInt64
+	var leaseExpiresAt, heartbeatAt sql.NullTime
+	err := row.Scan(&job.ID, &job.Type, &job.Queue, &job.Priority, &uniqueKey, &campaignID, &job.Payload, &job.RunAt, &job.Attempts, &job.Status,
+		&lockedBy, &leaseExpiresAt, &heartbeatAt, &lastError, &job.CreatedAt, &job.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
 
+	job.UniqueKey = uniqueKey.String
+	job.CampaignID = int(campaignID.Int64)
+	job.LockedBy = lockedBy.String
+	job.LastError = lastError.String
+	if leaseExpiresAt.Valid {
+		job.LeaseExpiresAt = &leaseExpiresAt.Time
+	}
+	if heartbeatAt.Valid {
+		job.HeartbeatAt = &heartbeatAt.Time
+	}
+
 	return &job, nil
 }
 
-func (s *Store) UpdateJobStatus(id int, status string) error {
-	query := `UPDATE jobs SET status = ?, updated_at = ? WHERE id = ?`
-	_, err := s.db.Exec(query, status, time.Now(), id)
-	return err
+// ClaimJob atomically picks the highest priority due job on queue, marks it
+// running and leases it to worker. The select and the update happen in a
+// single statement, so two workers (in this process or another one sharing
+// the database) can never claim the same row. Returns sql.ErrNoRows when
+// nothing is due.
+func (s *Store) ClaimJob(queue, worker string, lease time.Duration) (*Job, error) {
+	now := time.Now()
+	query := `UPDATE jobs SET status = 'running', locked_by = ?, lease_expires_at = ?, heartbeat_at = ?, updated_at = ?
+			  WHERE id = (SELECT id FROM jobs WHERE queue = ? AND status = 'queued' AND run_at <= ?
+			              ORDER BY priority DESC, run_at ASC, id ASC LIMIT 1)
+			  AND status = 'queued'
+			  RETURNING ` + jobColumns
+	row := s.db.QueryRow(query, worker, now.Add(lease), now, now, queue, now)
+	return scanJob(row)
 }
 
-func (s *Store) IncrementJobAttempts(id int) error {
-	query := `UPDATE jobs SET attempts = attempts + 1, updated_at = ? WHERE id = ?`
-	_, err := s.db.Exec(query, time.Now(), id)
-	return err
+// HeartbeatJob extends the lease on a running job held by worker.
+func (s *Store) HeartbeatJob(id int, worker string, lease time.Duration) error {
+	now := time.Now()
+	query := `UPDATE jobs SET lease_expires_at = ?, heartbeat_at = ?, updated_at = ?
+			  WHERE id = ? AND status = 'running' AND locked_by = ?`
+	result, err := s.db.Exec(query, now.Add(lease), now, now, id, worker)
+	if err != nil {
+		return err
+	}
+	return leaseResult(result)
 }
 
-// Domain methods
-func (s *Store) CreateDomain(domain *Domain) error {
-	query := `INSERT INTO domains (domain, dkim_selector, dkim_private_key, dkim_public_key, spf_record, dmarc_record, ptr_record) 
-			  VALUES (?, ?, ?, ?, ?, ?, ?)`
-	result, err := s.db.Exec(query, domain.Domain, domain.DKIMSelector, domain.DKIMPrivateKey, 
-		domain.DKIMPublicKey, domain.SPFRecord, domain.DMARCRecord, domain.PTRRecord)
+// FinishJob moves a running job held by worker to its final status and
+// releases the lease.
+func (s *Store) FinishJob(id int, worker, status string) error {
+	query := `UPDATE jobs SET status = ?, locked_by = NULL, lease_expires_at = NULL, updated_at = ?
+			  WHERE id = ? AND status = 'running' AND locked_by = ?`
+	result, err := s.db.Exec(query, status, time.Now(), id, worker)
 	if err != nil {
 		return err
 	}
+	return leaseResult(result)
+}
 
-	id, err := result.LastInsertId()
+func leaseResult(result sql.Result) error {
+	affected, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
-
-	domain.ID = int(id)
+	if affected == 0 {
+		return ErrLeaseLost
+	}
 	return nil
 }
 
-func (s *Store) GetDomain(id int) (*Domain, error) {
-	query := `SELECT id, domain, dkim_selector, dkim_private_key, dkim_public_key, spf_record, dmarc_record, ptr_record, verified_at, created_at 
-			  FROM domains WHERE id = ?`
-	row := s.db.QueryRow(query, id)
+// NextJobRunAt returns the earliest run_at of the queued jobs on queue, or
+// sql.ErrNoRows if the queue is empty.
+func (s *Store) NextJobRunAt(queue string) (time.Time, error) {
+	var next time.Time
+	query := `SELECT run_at FROM jobs WHERE queue = ? AND status = 'queued' ORDER BY run_at ASC LIMIT 1`
+	err := s.db.QueryRow(query, queue).Scan(&next)
+	return next, err
+}
 
-	var domain Domain
-	var verifiedAt sql.NullTime
-	err := row.Scan(&domain.ID, &domain.Domain, &domain.DKIMSelector, &domain.DKIMPrivateKey, 
-		&domain.DKIMPublicKey, &domain.SPFRecord, &domain.DMARCRecord, &domain.PTRRecord, &verifiedAt, &domain.CreatedAt)
+// GetRunningJobs returns every job currently marked running, regardless of
+// which worker holds it.
+func (s *Store) GetRunningJobs() ([]*Job, error) {
+	query := `SELECT ` + jobColumns + ` FROM jobs WHERE status = 'running' ORDER BY id ASC`
+	rows, err := s.db.Query(query)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	var jobs []*Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
 
-	if verifiedAt.Valid {
-		domain.VerifiedAt = &verifiedAt.Time
+	return jobs, rows.Err()
+}
+
+// RecoverJob takes a running job away from the worker recorded in
+// job.LockedBy, counts the interrupted run as an attempt and moves it to
+// status ("queued" to run again at runAt, or "failed"). The update only
+// applies if the job is still held by the same worker and its lease has not
+// been renewed since it was read, so concurrent reapers recover it once.
+func (s *Store) RecoverJob(job *Job, status string, runAt time.Time, leaseCheck bool) error {
+	now := time.Now()
+	query := `UPDATE jobs SET status = ?, attempts = attempts + 1, run_at = ?, locked_by = NULL, lease_expires_at = NULL, updated_at = ?
+			  WHERE id = ? AND status = 'running' AND locked_by IS ?`
+	args := []interface{}{status, runAt, now, job.ID, nullString(job.LockedBy)}
+	if leaseCheck {
+		query += ` AND (lease_expires_at IS NULL OR lease_expires_at < ?)`
+		args = append(args, now)
 	}
 
-	return &domain, nil
+	result, err := s.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	return leaseResult(result)
 }
 
-func (s *Store) GetDomains() ([]*Domain, error) {
-	query := `SELECT id, domain, dkim_selector, dkim_private_key, dkim_public_key, spf_record, dmarc_record, ptr_record, verified_at, created_at 
-			  FROM domains ORDER BY created_at DESC`
-	rows, err := s.db.Query(query)
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func (s *Store) GetJob(id int) (*Job, error) {
+	query := `SELECT ` + jobColumns + ` FROM jobs WHERE id = ?`
+	return scanJob(s.db.QueryRow(query, id))
+}
+
+// ListJobs returns jobs matching filter, newest first.
+func (s *Store) ListJobs(filter JobFilter) ([]*Job, error) {
+	query := `SELECT ` + jobColumns + ` FROM jobs WHERE 1 = 1`
+	var args []interface{}
+	if filter.Type != "" {
+		query += ` AND type = ?`
+		args = append(args, filter.Type)
+	}
+	if filter.Queue != "" {
+		query += ` AND queue = ?`
+		args = append(args, filter.Queue)
+	}
+	if filter.Status != "" {
+		query += ` AND status = ?`
+		args = append(args, filter.Status)
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	query += ` ORDER BY updated_at DESC, id DESC LIMIT ? OFFSET ?`
+	args = append(args, limit, filter.Offset)
+
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var domains []*Domain
+	jobs := []*Job{}
 	for rows.Next() {
-		var domain Domain
-		var verifiedAt sql.NullTime
-		err := rows.Scan(&domain.ID, &domain.Domain, &domain.DKIMSelector, &domain.DKIMPrivateKey, 
-			&domain.DKIMPublicKey, &domain.SPFRecord, &domain.DMARCRecord, &domain.PTRRecord, &verifiedAt, &domain.CreatedAt)
+		job, err := scanJob(rows)
 		if err != nil {
 			return nil, err
 		}
+		jobs = append(jobs, job)
+	}
 
-		if verifiedAt.Valid {
-			domain.VerifiedAt = &verifiedAt.Time
-		}
+	return jobs, rows.Err()
+}
 
-		domains = append(domains, &domain)
+// CountCampaignJobs counts the jobs of the given types that belong to a
+// campaign, by status.
+func (s *Store) CountCampaignJobs(campaignID int, jobTypes ...string) (map[string]int, error) {
+	if len(jobTypes) == 0 {
+		return map[string]int{}, nil
 	}
 
-	return domains, nil
+	args := []interface{}{campaignID}
+	for _, jobType := range jobTypes {
+		args = append(args, jobType)
+	}
+	query := `SELECT status, COUNT(*) FROM jobs
+			  WHERE campaign_id = ?
+			    AND type IN (?` + strings.Repeat(", ?", len(jobTypes)-1) + `)
+			  GROUP BY status`
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, err
+		}
+		counts[status] = n
+	}
+
+	return counts, rows.Err()
+}
+
+// RecordJobError appends to a job's error history and sets its last_error.
+func (s *Store) RecordJobError(jobID, attempt int, worker, message string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO job_errors (job_id, attempt, worker, error) VALUES (?, ?, ?, ?)`,
+		jobID, attempt, nullString(worker), message); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE jobs SET last_error = ? WHERE id = ?`, message, jobID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *Store) GetJobErrors(jobID int) ([]*JobError, error) {
+	query := `SELECT id, job_id, attempt, worker, error, at FROM job_errors WHERE job_id = ? ORDER BY id ASC`
+	rows, err := s.db.Query(query, jobID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobErrors := []*JobError{}
+	for rows.Next() {
+		var jobError JobError
+		var worker sql.NullString
+		err := rows.Scan(&jobError.ID, &jobError.JobID, &jobError.Attempt, &worker, &jobError.Error, &jobError.At)
+		if err != nil {
+			return nil, err
+		}
+		jobError.Worker = worker.String
+		jobErrors = append(jobErrors, &jobError)
+	}
+
+	return jobErrors, rows.Err()
+}
+
+// RetryJob moves a failed job back to the queue with a fresh set of
+// attempts. Its error history is kept. A job whose unique key was reused by
+// a live job in the meantime is not retried.
+func (s *Store) RetryJob(id int) error {
+	now := time.Now()
+	query := `UPDATE jobs SET status = 'queued', attempts = 0, run_at = ?, updated_at = ? WHERE id = ? AND status = 'failed'
+			  AND NOT EXISTS (SELECT 1 FROM jobs live WHERE live.unique_key = jobs.unique_key AND live.status IN ('queued', 'running'))`
+	result, err := s.db.Exec(query, now, now, id)
+	if err != nil {
+		return err
+	}
+	if err := failedJobResult(result); err != ErrJobNotFailed {
+		return err
+	}
+
+	var status string
+	if err := s.db.QueryRow(`SELECT status FROM jobs WHERE id = ?`, id).Scan(&status); err != nil {
+		return err
+	}
+	if status == "failed" {
+		return ErrJobDuplicate
+	}
+	return ErrJobNotFailed
+}
+
+// DiscardJob deletes a failed job together with its error history.
+func (s *Store) DiscardJob(id int) error {
+	result, err := s.db.Exec(`DELETE FROM jobs WHERE id = ? AND status = 'failed'`, id)
+	if err != nil {
+		return err
+	}
+	return failedJobResult(result)
+}
+
+// DeleteFinishedJobs removes completed jobs last updated before the given time.
+func (s *Store) DeleteFinishedJobs(before time.Time) (int64, error) {
+	result, err := s.db.Exec(`DELETE FROM jobs WHERE status = 'done' AND updated_at < ?`, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func failedJobResult(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrJobNotFailed
+	}
+	return nil
+}
+
+func (s *Store) UpdateJobStatus(id int, status string) error {
+	query := `UPDATE jobs SET status = ?, updated_at = ? WHERE id = ?`
+	_, err := s.db.Exec(query, status, time.Now(), id)
+	return err
+}
+
+// RescheduleJob puts a failed job held by worker back in the queue to run
+// again at runAt, counting the failed run as an attempt. The same row is
+// reused so a job never exists twice.
+func (s *Store) RescheduleJob(id int, worker string, runAt time.Time) error {
+	query := `UPDATE jobs SET status = 'queued', attempts = attempts + 1, run_at = ?, locked_by = NULL, lease_expires_at = NULL, updated_at = ?
+			  WHERE id = ? AND status = 'running' AND locked_by = ?`
+	result, err := s.db.Exec(query, runAt, time.Now(), id, worker)
+	if err != nil {
+		return err
+	}
+	return leaseResult(result)
+}
+
+// SnoozeJob puts a job held by worker back in the queue to run again at
+// runAt without counting the run as an attempt.
+func (s *Store) SnoozeJob(id int, worker string, runAt time.Time) error {
+	query := `UPDATE jobs SET status = 'queued', run_at = ?, locked_by = NULL, lease_expires_at = NULL, updated_at = ?
+			  WHERE id = ? AND status = 'running' AND locked_by = ?`
+	result, err := s.db.Exec(query, runAt, time.Now(), id, worker)
+	if err != nil {
+		return err
+	}
+	return leaseResult(result)
+}
+
+// FailJob moves a job held by worker to the dead-letter queue, counting the
+// failed run as an attempt.
+func (s *Store) FailJob(id int, worker string) error {
+	query := `UPDATE jobs SET status = 'failed', attempts = attempts + 1, locked_by = NULL, lease_expires_at = NULL, updated_at = ?
+			  WHERE id = ? AND status = 'running' AND locked_by = ?`
+	result, err := s.db.Exec(query, time.Now(), id, worker)
+	if err != nil {
+		return err
+	}
+	return leaseResult(result)
+}
+
+// Schedule methods
+const scheduleColumns = `id, name, cron_expr, job_type, payload, enabled, next_run_at, last_run_at, last_job_id, version, created_at, updated_at`
+
+func scanSchedule(row rowScanner) (*Schedule, error) {
+	var schedule Schedule
+	var payload []byte
+	var lastRunAt sql.NullTime
+	var lastJobID sql.NullInt64
+	err := row.Scan(&schedule.ID, &schedule.Name, &schedule.CronExpr, &schedule.JobType, &payload, &schedule.Enabled,
+		&schedule.NextRunAt, &lastRunAt, &lastJobID, &schedule.Version, &schedule.CreatedAt, &schedule.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	schedule.Payload = payload
+	if lastRunAt.Valid {
+		schedule.LastRunAt = &lastRunAt.Time
+	}
+	if lastJobID.Valid {
+		id := int(lastJobID.Int64)
+		schedule.LastJobID = &id
+	}
+
+	return &schedule, nil
+}
+
+func (s *Store) querySchedules(query string, args ...interface{}) ([]*Schedule, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schedules := []*Schedule{}
+	for rows.Next() {
+		schedule, err := scanSchedule(rows)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, schedule)
+	}
+
+	return schedules, rows.Err()
+}
+
+func (s *Store) CreateSchedule(schedule *Schedule) error {
+	query := `INSERT INTO schedules (name, cron_expr, job_type, payload, enabled, next_run_at) VALUES (?, ?, ?, ?, ?, ?)`
+	result, err := s.db.Exec(query, schedule.Name, schedule.CronExpr, schedule.JobType,
+		[]byte(schedule.Payload), schedule.Enabled, schedule.NextRunAt)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	schedule.ID = int(id)
+	return nil
+}
+
+// EnsureSchedule creates schedule unless one with the same name exists.
+// Existing schedules are left alone so edits made through the API stick.
+func (s *Store) EnsureSchedule(schedule *Schedule) error {
+	query := `INSERT INTO schedules (name, cron_expr, job_type, payload, enabled, next_run_at) VALUES (?, ?, ?, ?, ?, ?)
+			  ON CONFLICT(name) DO NOTHING`
+	_, err := s.db.Exec(query, schedule.Name, schedule.CronExpr, schedule.JobType,
+		[]byte(schedule.Payload), schedule.Enabled, schedule.NextRunAt)
+	return err
+}
+
+func (s *Store) GetSchedule(id int) (*Schedule, error) {
+	query := `SELECT ` + scheduleColumns + ` FROM schedules WHERE id = ?`
+	return scanSchedule(s.db.QueryRow(query, id))
+}
+
+func (s *Store) GetSchedules() ([]*Schedule, error) {
+	return s.querySchedules(`SELECT ` + scheduleColumns + ` FROM schedules ORDER BY name ASC`)
+}
+
+// GetDueSchedules returns enabled schedules whose next occurrence is at or
+// before now.
+func (s *Store) GetDueSchedules(now time.Time) ([]*Schedule, error) {
+	return s.querySchedules(`SELECT `+scheduleColumns+` FROM schedules
+			  WHERE enabled = 1 AND next_run_at <= ? ORDER BY next_run_at ASC`, now)
+}
+
+// NextScheduleRunAt returns the earliest next_run_at of any enabled
+// schedule, or sql.ErrNoRows if there is none.
+func (s *Store) NextScheduleRunAt() (time.Time, error) {
+	var next time.Time
+	err := s.db.QueryRow(`SELECT next_run_at FROM schedules WHERE enabled = 1 ORDER BY next_run_at ASC LIMIT 1`).Scan(&next)
+	return next, err
+}
+
+// UpdateSchedule saves the editable fields of schedule.
+func (s *Store) UpdateSchedule(schedule *Schedule) error {
+	query := `UPDATE schedules SET cron_expr = ?, job_type = ?, payload = ?, enabled = ?, next_run_at = ?,
+			  version = version + 1, updated_at = ? WHERE id = ?`
+	_, err := s.db.Exec(query, schedule.CronExpr, schedule.JobType, []byte(schedule.Payload),
+		schedule.Enabled, schedule.NextRunAt, time.Now(), schedule.ID)
+	return err
+}
+
+func (s *Store) DeleteSchedule(id int) error {
+	_, err := s.db.Exec(`DELETE FROM schedules WHERE id = ?`, id)
+	return err
+}
+
+// FireSchedule enqueues job for the schedule's current occurrence and moves
+// the schedule on to nextRunAt in a single transaction. The schedule row is
+// only advanced if its version is unchanged since it was read, so when
+// several instances (or a restarted one) race on the same occurrence exactly
+// one of them enqueues it. Returns false if another instance won.
+func (s *Store) FireSchedule(schedule *Schedule, job *Job, nextRunAt time.Time) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	result, err := tx.Exec(`UPDATE schedules SET next_run_at = ?, last_run_at = ?, version = version + 1, updated_at = ?
+			  WHERE id = ? AND version = ?`, nextRunAt, now, now, schedule.ID, schedule.Version)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if affected == 0 {
+		return false, nil
+	}
+
+	if _, err := insertJob(tx, job); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`UPDATE schedules SET last_job_id = ? WHERE id = ?`, job.ID, schedule.ID); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// EnsureSetting stores value under key unless the key is already set, and
+// returns the stored value.
+func (s *Store) EnsureSetting(key, value string) (string, error) {
+	query := `INSERT OR IGNORE INTO settings (setting_key, setting_value) VALUES (?, ?)`
+	if _, err := s.db.Exec(query, key, value); err != nil {
+		return "", err
+	}
+
+	var stored string
+	err := s.db.QueryRow(`SELECT setting_value FROM settings WHERE setting_key = ?`, key).Scan(&stored)
+	return stored, err
+}
+
+// Domain methods
+// CreateDomain stores domain and sets its ID. Its DKIM keys are recorded as
+// the domain's active keys.
+func (s *Store) CreateDomain(domain *Domain) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO domains (domain, dkim_selector, dkim_private_key, dkim_public_key, spf_record, dmarc_record, ptr_record,
+			  dkim_ed25519_selector, dkim_ed25519_private_key, dkim_ed25519_public_key, tracking_host) 
+			  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	result, err := tx.Exec(query, domain.Domain, domain.DKIMSelector, domain.DKIMPrivateKey, 
+		domain.DKIMPublicKey, domain.SPFRecord, domain.DMARCRecord, domain.PTRRecord,
+		nullString(domain.DKIMEd25519Selector), nullString(domain.DKIMEd25519PrivateKey), nullString(domain.DKIMEd25519PublicKey),
+		nullString(domain.TrackingHost))
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	keys := []*DomainKey{{Algorithm: "rsa", Selector: domain.DKIMSelector, PrivateKey: domain.DKIMPrivateKey, PublicKey: domain.DKIMPublicKey}}
+	if domain.DKIMEd25519Selector != "" {
+		keys = append(keys, &DomainKey{Algorithm: "ed25519", Selector: domain.DKIMEd25519Selector,
+			PrivateKey: domain.DKIMEd25519PrivateKey, PublicKey: domain.DKIMEd25519PublicKey})
+	}
+	for _, key := range keys {
+		key.DomainID = int(id)
+		key.Status = "active"
+		if err := insertDomainKey(tx, key); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	domain.ID = int(id)
+	return nil
+}
+
+const domainColumns = `id, domain, dkim_selector, dkim_private_key, dkim_public_key, spf_record, dmarc_record, ptr_record, verified_at, created_at,
+	dkim_ed25519_selector, dkim_ed25519_private_key, dkim_ed25519_public_key, tracking_host`
+
+func scanDomain(row rowScanner) (*Domain, error) {
+	var domain Domain
+	var verifiedAt sql.NullTime
+	var edSelector, edPrivateKey, edPublicKey, trackingHost sql.NullString
+	err := row.Scan(&domain.ID, &domain.Domain, &domain.DKIMSelector, &domain.DKIMPrivateKey, 
+		&domain.DKIMPublicKey, &domain.SPFRecord, &domain.DMARCRecord, &domain.PTRRecord, &verifiedAt, &domain.CreatedAt,
+		&edSelector, &edPrivateKey, &edPublicKey, &trackingHost)
+	if err != nil {
+		return nil, err
+	}
+
+	if verifiedAt.Valid {
+		domain.VerifiedAt = &verifiedAt.Time
+	}
+	domain.DKIMEd25519Selector = edSelector.String
+	domain.DKIMEd25519PrivateKey = edPrivateKey.String
+	domain.DKIMEd25519PublicKey = edPublicKey.String
+	domain.TrackingHost = trackingHost.String
+
+	return &domain, nil
+}
+
+func (s *Store) GetDomain(id int) (*Domain, error) {
+	query := `SELECT ` + domainColumns + ` FROM domains WHERE id = ?`
+	return scanDomain(s.db.QueryRow(query, id))
+}
+
+// GetDomainByName looks up a sending domain by name, ignoring case.
+func (s *Store) GetDomainByName(name string) (*Domain, error) {
+	query := `SELECT ` + domainColumns + ` FROM domains WHERE domain = ? COLLATE NOCASE`
+	return scanDomain(s.db.QueryRow(query, name))
+}
+
+func (s *Store) GetDomains() ([]*Domain, error) {
+	query := `SELECT ` + domainColumns + ` FROM domains ORDER BY created_at DESC`
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var domains []*Domain
+	for rows.Next() {
+		domain, err := scanDomain(rows)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, domain)
+	}
+
+	return domains, nil
+}
+
+// Domain key methods
+func insertDomainKey(db dbtx, key *DomainKey) error {
+	query := `INSERT INTO domain_keys (domain_id, algorithm, selector, private_key, public_key, status, activated_at)
+			  VALUES (?, ?, ?, ?, ?, ?, CASE WHEN ? = 'active' THEN CURRENT_TIMESTAMP END)`
+	result, err := db.Exec(query, key.DomainID, key.Algorithm, key.Selector, key.PrivateKey, key.PublicKey, key.Status, key.Status)
+	if err != nil {
+		return err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+
+	key.ID = int(id)
+	return nil
+}
+
+func addDomainKeyHistory(db dbtx, domainID, keyID int, stage, message string) error {
+	query := `INSERT INTO domain_key_history (domain_id, key_id, stage, message) VALUES (?, ?, ?, ?)`
+	_, err := db.Exec(query, domainID, keyID, stage, nullString(message))
+	return err
+}
+
+// CreatePendingDomainKey stores a new pending key, sets its ID and records
+// the message, typically the DNS record to publish, in its history.
+func (s *Store) CreatePendingDomainKey(key *DomainKey, message string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	key.Status = "pending"
+	if err := insertDomainKey(tx, key); err != nil {
+		return err
+	}
+	if err := addDomainKeyHistory(tx, key.DomainID, key.ID, "pending", message); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const domainKeyColumns = `id, domain_id, algorithm, selector, private_key, public_key, status, created_at, activated_at, retire_at, retired_at`
+
+func scanDomainKey(row rowScanner) (*DomainKey, error) {
+	var key DomainKey
+	var activatedAt, retireAt, retiredAt sql.NullTime
+	err := row.Scan(&key.ID, &key.DomainID, &key.Algorithm, &key.Selector, &key.PrivateKey, &key.PublicKey,
+		&key.Status, &key.CreatedAt, &activatedAt, &retireAt, &retiredAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if activatedAt.Valid {
+		key.ActivatedAt = &activatedAt.Time
+	}
+	if retireAt.Valid {
+		key.RetireAt = &retireAt.Time
+	}
+	if retiredAt.Valid {
+		key.RetiredAt = &retiredAt.Time
+	}
+
+	return &key, nil
+}
+
+func (s *Store) GetDomainKey(id int) (*DomainKey, error) {
+	query := `SELECT ` + domainKeyColumns + ` FROM domain_keys WHERE id = ?`
+	return scanDomainKey(s.db.QueryRow(query, id))
+}
+
+// GetDomainKeys returns the domain's keys, newest first.
+func (s *Store) GetDomainKeys(domainID int) ([]*DomainKey, error) {
+	query := `SELECT ` + domainKeyColumns + ` FROM domain_keys WHERE domain_id = ? ORDER BY id DESC`
+	rows, err := s.db.Query(query, domainID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*DomainKey{}
+	for rows.Next() {
+		key, err := scanDomainKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// GetDomainKeyHistory returns the rotation history of the domain's keys,
+// oldest first.
+func (s *Store) GetDomainKeyHistory(domainID int) ([]*DomainKeyHistory, error) {
+	query := `SELECT id, domain_id, key_id, stage, message, at FROM domain_key_history WHERE domain_id = ? ORDER BY id`
+	rows, err := s.db.Query(query, domainID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []*DomainKeyHistory{}
+	for rows.Next() {
+		var entry DomainKeyHistory
+		var message sql.NullString
+		if err := rows.Scan(&entry.ID, &entry.DomainID, &entry.KeyID, &entry.Stage, &message, &entry.At); err != nil {
+			return nil, err
+		}
+		entry.Message = message.String
+		history = append(history, &entry)
+	}
+
+	return history, rows.Err()
+}
+
+// AddDomainKeyHistory records a rotation stage for a key.
+func (s *Store) AddDomainKeyHistory(domainID, keyID int, stage, message string) error {
+	return addDomainKeyHistory(s.db, domainID, keyID, stage, message)
+}
+
+// ActivateDomainKey switches signing for the key's domain and algorithm to
+// the pending key. The previously active key becomes retiring until
+// retireAt.
+func (s *Store) ActivateDomainKey(key *DomainKey, retireAt time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current []int
+	rows, err := tx.Query(`SELECT id FROM domain_keys WHERE domain_id = ? AND algorithm = ? AND status = 'active'`,
+		key.DomainID, key.Algorithm)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		current = append(current, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, id := range current {
+		if _, err := tx.Exec(`UPDATE domain_keys SET status = 'retiring', retire_at = ? WHERE id = ?`, retireAt, id); err != nil {
+			return err
+		}
+		message := fmt.Sprintf("replaced by %s, keep its DNS record until %s", key.Selector, retireAt.Format(time.RFC3339))
+		if err := addDomainKeyHistory(tx, key.DomainID, id, "retiring", message); err != nil {
+			return err
+		}
+	}
+
+	result, err := tx.Exec(`UPDATE domain_keys SET status = 'active', activated_at = ? WHERE id = ? AND status = 'pending'`,
+		time.Now(), key.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("domain key %d is no longer pending", key.ID)
+	}
+
+	query := `UPDATE domains SET dkim_selector = ?, dkim_private_key = ?, dkim_public_key = ? WHERE id = ?`
+	if key.Algorithm == "ed25519" {
+		query = `UPDATE domains SET dkim_ed25519_selector = ?, dkim_ed25519_private_key = ?, dkim_ed25519_public_key = ? WHERE id = ?`
+	}
+	if _, err := tx.Exec(query, key.Selector, key.PrivateKey, key.PublicKey, key.DomainID); err != nil {
+		return err
+	}
+	if err := addDomainKeyHistory(tx, key.DomainID, key.ID, "active", "now signing outgoing mail"); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpdateDomainKeyStatus moves a key to status, recording message in its
+// history. Retired keys lose their private key, which is no longer needed.
+func (s *Store) UpdateDomainKeyStatus(key *DomainKey, status, message string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE domain_keys SET status = ? WHERE id = ?`
+	if status == "retired" {
+		query = `UPDATE domain_keys SET status = ?, private_key = '', retired_at = CURRENT_TIMESTAMP WHERE id = ?`
+	}
+	if _, err := tx.Exec(query, status, key.ID); err != nil {
+		return err
+	}
+	if err := addDomainKeyHistory(tx, key.DomainID, key.ID, status, message); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Domain warm-up methods
+// SetDomainWarmup gives a domain a warm-up plan starting today, replacing
+// any plan it had.
+func (s *Store) SetDomainWarmup(domainID int, schedule []int) (*DomainWarmup, error) {
+	data, err := json.Marshal(schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `INSERT INTO domain_warmups (domain_id, schedule, started_at) VALUES (?, ?, ?)
+			  ON CONFLICT (domain_id) DO UPDATE SET schedule = excluded.schedule, started_at = excluded.started_at`
+	if _, err := s.db.Exec(query, domainID, string(data), time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	return s.GetDomainWarmup(domainID)
+}
+
+// GetDomainWarmup returns the domain's warm-up plan, or sql.ErrNoRows if it
+// has none.
+func (s *Store) GetDomainWarmup(domainID int) (*DomainWarmup, error) {
+	var warmup DomainWarmup
+	var schedule string
+	query := `SELECT domain_id, schedule, started_at, created_at FROM domain_warmups WHERE domain_id = ?`
+	err := s.db.QueryRow(query, domainID).Scan(&warmup.DomainID, &schedule, &warmup.StartedAt, &warmup.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(schedule), &warmup.Schedule); err != nil {
+		return nil, fmt.Errorf("invalid warm-up schedule for domain %d: %w", domainID, err)
+	}
+	return &warmup, nil
+}
+
+func (s *Store) DeleteDomainWarmup(domainID int) error {
+	_, err := s.db.Exec(`DELETE FROM domain_warmups WHERE domain_id = ?`, domainID)
+	return err
+}
+
+// GetWarmupUsage returns how many messages the domain sent on day
+// (YYYY-MM-DD).
+func (s *Store) GetWarmupUsage(domainID int, day string) (int, error) {
+	var sent int
+	err := s.db.QueryRow(`SELECT sent FROM domain_warmup_usage WHERE domain_id = ? AND day = ?`, domainID, day).Scan(&sent)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return sent, err
+}
+
+// ConsumeWarmupQuota counts one message against the domain's limit for
+// day. It returns false, counting nothing, once limit messages were sent.
+func (s *Store) ConsumeWarmupQuota(domainID int, day string, limit int) (bool, error) {
+	if limit <= 0 {
+		return false, nil
+	}
+	query := `INSERT INTO domain_warmup_usage (domain_id, day, sent) VALUES (?, ?, 1)
+			  ON CONFLICT (domain_id, day) DO UPDATE SET sent = sent + 1 WHERE sent < ?`
+	result, err := s.db.Exec(query, domainID, day, limit)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// ReleaseWarmupQuota gives back a message counted by ConsumeWarmupQuota
+// that was not sent after all.
+func (s *Store) ReleaseWarmupQuota(domainID int, day string) error {
+	query := `UPDATE domain_warmup_usage SET sent = sent - 1 WHERE domain_id = ? AND day = ? AND sent > 0`
+	_, err := s.db.Exec(query, domainID, day)
+	return err
+}
+
+// SetDomainTrackingHost sets the tracking host of a domain; an empty host
+// removes it.
+func (s *Store) SetDomainTrackingHost(id int, host string) error {
+	query := `UPDATE domains SET tracking_host = ? WHERE id = ?`
+	_, err := s.db.Exec(query, nullString(host), id)
+	return err
 }
 
 func (s *Store) UpdateDomainVerification(id int, verified bool) error {
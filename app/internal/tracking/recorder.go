@@ -0,0 +1,117 @@
+package tracking
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"newsletter/internal/store"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultRecorderBuffer is how many events can wait to be written
+	// before new ones are dropped
+	DefaultRecorderBuffer = 10000
+
+	recorderBatchSize     = 500
+	recorderFlushInterval = time.Second
+)
+
+// Recorder writes tracking events in the background. Requests hand events
+// over without waiting for the database, and events are written in
+// batches, one transaction each, so a burst of opens does not turn into a
+// burst of competing SQLite writes.
+type Recorder struct {
+	db     *store.Store
+	events chan *store.Event
+	done   chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewRecorder(db *store.Store, buffer int) *Recorder {
+	if buffer <= 0 {
+		buffer = DefaultRecorderBuffer
+	}
+	return &Recorder{
+		db:     db,
+		events: make(chan *store.Event, buffer),
+		done:   make(chan struct{}),
+	}
+}
+
+// Record queues an event. It never blocks: if the buffer is full, or the
+// recorder has shut down, the event is dropped with a warning.
+func (r *Recorder) Record(campaignID, subscriberID int, eventType string, meta json.RawMessage) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.closed {
+		logrus.Warnf("Event recorder is shut down, dropping %s event", eventType)
+		return
+	}
+
+	event := &store.Event{CampaignID: campaignID, SubscriberID: subscriberID, Type: eventType, Meta: meta, At: time.Now()}
+	select {
+	case r.events <- event:
+	default:
+		logrus.Warnf("Event buffer full, dropping %s event for campaign %d", eventType, campaignID)
+	}
+}
+
+// Run writes queued events until Shutdown, then flushes what is left.
+func (r *Recorder) Run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(recorderFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*store.Event, 0, recorderBatchSize)
+	for {
+		select {
+		case event, ok := <-r.events:
+			if !ok {
+				r.flush(batch)
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) < recorderBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		r.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+func (r *Recorder) flush(batch []*store.Event) {
+	if len(batch) == 0 {
+		return
+	}
+	recorded, err := r.db.RecordEvents(batch)
+	if err != nil {
+		logrus.Errorf("Recorded %d of %d events: %v", recorded, len(batch), err)
+	}
+}
+
+// Shutdown stops accepting events and waits until the queued ones are
+// written or ctx is done.
+func (r *Recorder) Shutdown(ctx context.Context) error {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.events)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,221 @@
+package tracking
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// macSize is the length of the truncated HMAC-SHA256 in a token; 128 bits
+// is plenty against forgery and keeps links short.
+const macSize = 16
+
+// ErrInvalidToken is returned for tokens that are malformed or whose
+// signature does not match, i.e. that were not issued by us.
+var ErrInvalidToken = errors.New("invalid token")
+
+// addressEncoding encodes tokens in mail addresses. The local part of an
+// address may be case-folded on its way to us, so unlike links these use a
+// case-insensitive alphabet.
+var addressEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// Token purposes. Each is signed separately so a token issued for one
+// purpose cannot be replayed as another.
+const (
+	purposeClick       = "click"
+	purposeOpen        = "open"
+	purposeUnsubscribe = "unsubscribe"
+)
+
+// Signer issues and verifies the opaque tokens in tracking links. A token
+// carries its data and an HMAC over it, so links need no lookup and cannot
+// be forged or altered.
+type Signer struct {
+	key []byte
+}
+
+func NewSigner(secret string) *Signer {
+	return &Signer{key: []byte(secret)}
+}
+
+// GenerateSecret returns a random secret for NewSigner.
+func GenerateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate secret: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *Signer) sign(purpose string, data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(s.seal(purpose, data))
+}
+
+func (s *Signer) verify(purpose, token string) ([]byte, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	return s.open(purpose, raw)
+}
+
+// seal appends the MAC of data to it.
+func (s *Signer) seal(purpose string, data []byte) []byte {
+	return append(append([]byte(nil), data...), s.mac(purpose, data)...)
+}
+
+// open checks the MAC of a token from seal and returns its data.
+func (s *Signer) open(purpose string, raw []byte) ([]byte, error) {
+	if len(raw) < macSize {
+		return nil, ErrInvalidToken
+	}
+	data, mac := raw[:len(raw)-macSize], raw[len(raw)-macSize:]
+	if !hmac.Equal(mac, s.mac(purpose, data)) {
+		return nil, ErrInvalidToken
+	}
+	return data, nil
+}
+
+func (s *Signer) mac(purpose string, data []byte) []byte {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(purpose))
+	h.Write([]byte{0})
+	h.Write(data)
+	return h.Sum(nil)[:macSize]
+}
+
+// Click identifies a tracked link in a campaign sent to a subscriber.
+type Click struct {
+	CampaignID   int
+	SubscriberID int
+	// Index is the link's position among the tracked links of the message
+	Index int
+	URL   string
+}
+
+// ClickToken returns the token of a tracked link.
+func (s *Signer) ClickToken(c Click) string {
+	data := appendInts(nil, c.CampaignID, c.SubscriberID, c.Index)
+	return s.sign(purposeClick, append(data, c.URL...))
+}
+
+// ParseClickToken verifies a token from ClickToken and returns its link.
+func (s *Signer) ParseClickToken(token string) (*Click, error) {
+	data, err := s.verify(purposeClick, token)
+	if err != nil {
+		return nil, err
+	}
+
+	ints, rest, err := readInts(data, 3)
+	if err != nil {
+		return nil, err
+	}
+	return &Click{CampaignID: ints[0], SubscriberID: ints[1], Index: ints[2], URL: string(rest)}, nil
+}
+
+// Open identifies the open-tracking pixel of a campaign sent to a
+// subscriber.
+type Open struct {
+	CampaignID   int
+	SubscriberID int
+}
+
+// OpenToken returns the token of an open-tracking pixel.
+func (s *Signer) OpenToken(o Open) string {
+	return s.sign(purposeOpen, appendInts(nil, o.CampaignID, o.SubscriberID))
+}
+
+// ParseOpenToken verifies a token from OpenToken.
+func (s *Signer) ParseOpenToken(token string) (*Open, error) {
+	data, err := s.verify(purposeOpen, token)
+	if err != nil {
+		return nil, err
+	}
+
+	ints, rest, err := readInts(data, 2)
+	if err != nil || len(rest) > 0 {
+		return nil, ErrInvalidToken
+	}
+	return &Open{CampaignID: ints[0], SubscriberID: ints[1]}, nil
+}
+
+// Unsubscribe identifies the unsubscribe link of a subscriber, in a
+// campaign or, with a zero CampaignID, elsewhere.
+type Unsubscribe struct {
+	CampaignID   int
+	SubscriberID int
+}
+
+// UnsubscribeToken returns the token of an unsubscribe link. Unlike a
+// subscriber ID it cannot be guessed, so only the recipient can
+// unsubscribe.
+func (s *Signer) UnsubscribeToken(u Unsubscribe) string {
+	return s.sign(purposeUnsubscribe, appendInts(nil, u.CampaignID, u.SubscriberID))
+}
+
+// ParseUnsubscribeToken verifies a token from UnsubscribeToken.
+func (s *Signer) ParseUnsubscribeToken(token string) (*Unsubscribe, error) {
+	data, err := s.verify(purposeUnsubscribe, token)
+	if err != nil {
+		return nil, err
+	}
+	return parseUnsubscribe(data)
+}
+
+// UnsubscribeAddressToken returns the token of an unsubscribe mail address.
+// It is lowercase base32, so it survives MTAs that change the case of the
+// local part.
+func (s *Signer) UnsubscribeAddressToken(u Unsubscribe) string {
+	data := appendInts(nil, u.CampaignID, u.SubscriberID)
+	return addressEncoding.EncodeToString(s.seal(purposeUnsubscribe, data))
+}
+
+// ParseUnsubscribeAddressToken verifies a token from
+// UnsubscribeAddressToken, in any case.
+func (s *Signer) ParseUnsubscribeAddressToken(token string) (*Unsubscribe, error) {
+	raw, err := addressEncoding.DecodeString(strings.ToLower(token))
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	data, err := s.open(purposeUnsubscribe, raw)
+	if err != nil {
+		return nil, err
+	}
+	return parseUnsubscribe(data)
+}
+
+func parseUnsubscribe(data []byte) (*Unsubscribe, error) {
+	ints, rest, err := readInts(data, 2)
+	if err != nil || len(rest) > 0 {
+		return nil, ErrInvalidToken
+	}
+	return &Unsubscribe{CampaignID: ints[0], SubscriberID: ints[1]}, nil
+}
+
+func appendInts(b []byte, ints ...int) []byte {
+	for _, n := range ints {
+		b = binary.AppendUvarint(b, uint64(n))
+	}
+	return b
+}
+
+func readInts(data []byte, n int) ([]int, []byte, error) {
+	r := bytes.NewReader(data)
+	ints := make([]int, n)
+	for i := range ints {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, nil, ErrInvalidToken
+		}
+		ints[i] = int(v)
+	}
+	return ints, data[len(data)-r.Len():], nil
+}
@@ -0,0 +1,148 @@
+package tracking
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+var (
+	testClick       = Click{CampaignID: 12, SubscriberID: 3456, Index: 2, URL: "https://example.com/a?b=c"}
+	testOpen        = Open{CampaignID: 12, SubscriberID: 3456}
+	testUnsubscribe = Unsubscribe{CampaignID: 12, SubscriberID: 3456}
+)
+
+func TestTokensRoundTrip(t *testing.T) {
+	s := NewSigner("secret")
+
+	click, err := s.ParseClickToken(s.ClickToken(testClick))
+	if err != nil || *click != testClick {
+		t.Errorf("click = %+v, %v, want %+v", click, err, testClick)
+	}
+	open, err := s.ParseOpenToken(s.OpenToken(testOpen))
+	if err != nil || *open != testOpen {
+		t.Errorf("open = %+v, %v, want %+v", open, err, testOpen)
+	}
+	unsub, err := s.ParseUnsubscribeToken(s.UnsubscribeToken(testUnsubscribe))
+	if err != nil || *unsub != testUnsubscribe {
+		t.Errorf("unsubscribe = %+v, %v, want %+v", unsub, err, testUnsubscribe)
+	}
+}
+
+func TestFlippedBit(t *testing.T) {
+	s := NewSigner("secret")
+	raw, err := base64.RawURLEncoding.DecodeString(s.ClickToken(testClick))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range raw {
+		for bit := 0; bit < 8; bit++ {
+			tampered := append([]byte(nil), raw...)
+			tampered[i] ^= 1 << bit
+			token := base64.RawURLEncoding.EncodeToString(tampered)
+			if _, err := s.ParseClickToken(token); !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("byte %d bit %d flipped: err = %v, want ErrInvalidToken", i, bit, err)
+			}
+		}
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	s := NewSigner("secret")
+	token := s.OpenToken(testOpen)
+
+	for n := 0; n < len(token); n++ {
+		if _, err := s.ParseOpenToken(token[:n]); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("token cut to %d chars: err = %v, want ErrInvalidToken", n, err)
+		}
+	}
+}
+
+func TestWrongPurpose(t *testing.T) {
+	s := NewSigner("secret")
+
+	// Same data as testOpen and testUnsubscribe, so only the purpose differs
+	click := s.ClickToken(Click{CampaignID: 12, SubscriberID: 3456})
+	if _, err := s.ParseOpenToken(click); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("click token as open: err = %v, want ErrInvalidToken", err)
+	}
+	if _, err := s.ParseUnsubscribeToken(click); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("click token as unsubscribe: err = %v, want ErrInvalidToken", err)
+	}
+
+	open := s.OpenToken(testOpen)
+	if _, err := s.ParseUnsubscribeToken(open); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("open token as unsubscribe: err = %v, want ErrInvalidToken", err)
+	}
+	if _, err := s.ParseClickToken(open); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("open token as click: err = %v, want ErrInvalidToken", err)
+	}
+
+	unsub := s.UnsubscribeToken(testUnsubscribe)
+	if _, err := s.ParseOpenToken(unsub); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("unsubscribe token as open: err = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestWrongKey(t *testing.T) {
+	s := NewSigner("secret")
+	other := NewSigner("other secret")
+
+	if _, err := other.ParseClickToken(s.ClickToken(testClick)); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("click: err = %v, want ErrInvalidToken", err)
+	}
+	if _, err := other.ParseOpenToken(s.OpenToken(testOpen)); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("open: err = %v, want ErrInvalidToken", err)
+	}
+	if _, err := other.ParseUnsubscribeToken(s.UnsubscribeToken(testUnsubscribe)); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("unsubscribe: err = %v, want ErrInvalidToken", err)
+	}
+	if _, err := other.ParseUnsubscribeAddressToken(s.UnsubscribeAddressToken(testUnsubscribe)); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("unsubscribe address: err = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestTrailingBytes(t *testing.T) {
+	s := NewSigner("secret")
+
+	// Bytes after the MAC
+	raw, err := base64.RawURLEncoding.DecodeString(s.OpenToken(testOpen))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(append(raw, 0))
+	if _, err := s.ParseOpenToken(token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("bytes after the MAC: err = %v, want ErrInvalidToken", err)
+	}
+
+	// Correctly signed, but with more data than an open or unsubscribe holds
+	data := append(appendInts(nil, 12, 3456), 'x')
+	if _, err := s.ParseOpenToken(s.sign(purposeOpen, data)); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("open with trailing data: err = %v, want ErrInvalidToken", err)
+	}
+	if _, err := s.ParseUnsubscribeToken(s.sign(purposeUnsubscribe, data)); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("unsubscribe with trailing data: err = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestUnsubscribeAddressToken(t *testing.T) {
+	s := NewSigner("secret")
+	token := s.UnsubscribeAddressToken(testUnsubscribe)
+	if token != strings.ToLower(token) {
+		t.Errorf("token %q is not lowercase", token)
+	}
+
+	// MTAs may change the case of the local part
+	for _, variant := range []string{token, strings.ToUpper(token)} {
+		unsub, err := s.ParseUnsubscribeAddressToken(variant)
+		if err != nil || *unsub != testUnsubscribe {
+			t.Errorf("ParseUnsubscribeAddressToken(%q) = %+v, %v, want %+v", variant, unsub, err, testUnsubscribe)
+		}
+	}
+
+	if _, err := s.ParseUnsubscribeAddressToken(s.UnsubscribeToken(testUnsubscribe)); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("link token as address token: err = %v, want ErrInvalidToken", err)
+	}
+}
@@ -0,0 +1,9 @@
+-- SQLite Migration: 002_job_leases.sql
+-- Lease columns used by workers to claim jobs atomically
+
+ALTER TABLE jobs ADD COLUMN locked_by TEXT;
+ALTER TABLE jobs ADD COLUMN lease_expires_at DATETIME;
+ALTER TABLE jobs ADD COLUMN heartbeat_at DATETIME;
+
+CREATE INDEX IF NOT EXISTS idx_jobs_status_run_at ON jobs(status, run_at);
+CREATE INDEX IF NOT EXISTS idx_jobs_lease_expires_at ON jobs(lease_expires_at);
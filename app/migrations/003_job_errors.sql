@@ -0,0 +1,16 @@
+-- SQLite Migration: 003_job_errors.sql
+-- Error history for jobs, used by the dead-letter queue API
+
+ALTER TABLE jobs ADD COLUMN last_error TEXT;
+
+CREATE TABLE IF NOT EXISTS job_errors (
+  id INTEGER PRIMARY KEY,
+  job_id INTEGER NOT NULL,
+  attempt INTEGER NOT NULL,
+  worker TEXT,
+  error TEXT NOT NULL,
+  at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY (job_id) REFERENCES jobs(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_job_errors_job_id ON job_errors(job_id);
@@ -0,0 +1,7 @@
+-- SQLite Migration: 004_job_queues.sql
+-- Named queues and priorities so job types get separate worker pools
+
+ALTER TABLE jobs ADD COLUMN queue TEXT NOT NULL DEFAULT 'default';
+ALTER TABLE jobs ADD COLUMN priority INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS idx_jobs_claim ON jobs(queue, status, priority DESC, run_at);
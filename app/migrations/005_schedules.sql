@@ -0,0 +1,20 @@
+-- SQLite Migration: 005_schedules.sql
+-- Recurring (cron-style) jobs
+
+CREATE TABLE IF NOT EXISTS schedules (
+  id INTEGER PRIMARY KEY,
+  name TEXT NOT NULL UNIQUE,
+  cron_expr TEXT NOT NULL,
+  job_type TEXT NOT NULL,
+  payload JSON NOT NULL,
+  enabled BOOLEAN NOT NULL DEFAULT 1,
+  next_run_at DATETIME NOT NULL,
+  last_run_at DATETIME,
+  last_job_id INTEGER,
+  -- bumped on every change; firing an occurrence is a compare-and-swap on it
+  version INTEGER NOT NULL DEFAULT 0,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_schedules_next_run_at ON schedules(enabled, next_run_at);
@@ -0,0 +1,6 @@
+-- SQLite Migration: 006_job_unique_keys.sql
+-- Optional uniqueness key so the same logical job is only enqueued once
+
+ALTER TABLE jobs ADD COLUMN unique_key TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_jobs_unique_key ON jobs(unique_key) WHERE unique_key IS NOT NULL;
@@ -0,0 +1,19 @@
+-- SQLite Migration: 007_campaign_recipients.sql
+-- Per-recipient delivery ledger so campaign sends resume without duplicates
+
+CREATE TABLE IF NOT EXISTS campaign_recipients (
+  campaign_id INTEGER NOT NULL,
+  subscriber_id INTEGER NOT NULL,
+  email TEXT NOT NULL,
+  status TEXT NOT NULL DEFAULT 'pending' CHECK (status IN ('pending','sending','sent','failed')),
+  smtp_response TEXT,
+  attempts INTEGER NOT NULL DEFAULT 0,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY(campaign_id, subscriber_id),
+  FOREIGN KEY (campaign_id) REFERENCES campaigns(id) ON DELETE CASCADE,
+  FOREIGN KEY (subscriber_id) REFERENCES subscribers(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_campaign_recipients_status ON campaign_recipients(campaign_id, status);
+CREATE INDEX IF NOT EXISTS idx_campaign_recipients_email ON campaign_recipients(email);
@@ -0,0 +1,6 @@
+-- SQLite Migration: 008_domain_ed25519_keys.sql
+-- Optional Ed25519 DKIM key (RFC 8463), signed alongside the RSA key
+
+ALTER TABLE domains ADD COLUMN dkim_ed25519_selector TEXT;
+ALTER TABLE domains ADD COLUMN dkim_ed25519_private_key TEXT;
+ALTER TABLE domains ADD COLUMN dkim_ed25519_public_key TEXT;
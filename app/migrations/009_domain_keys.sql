@@ -0,0 +1,42 @@
+-- SQLite Migration: 009_domain_keys.sql
+-- DKIM keys per domain with their rotation state, and a history of rotation
+-- stages. The domains table keeps the active keys used for signing.
+
+CREATE TABLE IF NOT EXISTS domain_keys (
+  id INTEGER PRIMARY KEY,
+  domain_id INTEGER NOT NULL,
+  algorithm TEXT NOT NULL CHECK (algorithm IN ('rsa','ed25519')),
+  selector TEXT NOT NULL,
+  private_key TEXT NOT NULL,
+  public_key TEXT NOT NULL,
+  status TEXT NOT NULL CHECK (status IN ('pending','active','retiring','retired','failed')),
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  activated_at DATETIME,
+  retire_at DATETIME,
+  retired_at DATETIME,
+  UNIQUE(domain_id, selector),
+  FOREIGN KEY (domain_id) REFERENCES domains(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_domain_keys_domain_id ON domain_keys(domain_id, algorithm, status);
+
+CREATE TABLE IF NOT EXISTS domain_key_history (
+  id INTEGER PRIMARY KEY,
+  domain_id INTEGER NOT NULL,
+  key_id INTEGER NOT NULL,
+  stage TEXT NOT NULL,
+  message TEXT,
+  at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY (domain_id) REFERENCES domains(id) ON DELETE CASCADE,
+  FOREIGN KEY (key_id) REFERENCES domain_keys(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS idx_domain_key_history_domain_id ON domain_key_history(domain_id);
+
+-- Existing keys are the active ones
+INSERT INTO domain_keys (domain_id, algorithm, selector, private_key, public_key, status, created_at, activated_at)
+SELECT id, 'rsa', dkim_selector, dkim_private_key, dkim_public_key, 'active', created_at, created_at FROM domains;
+
+INSERT INTO domain_keys (domain_id, algorithm, selector, private_key, public_key, status, created_at, activated_at)
+SELECT id, 'ed25519', dkim_ed25519_selector, dkim_ed25519_private_key, dkim_ed25519_public_key, 'active', created_at, created_at
+FROM domains WHERE dkim_ed25519_selector IS NOT NULL;
@@ -0,0 +1,19 @@
+-- SQLite Migration: 010_domain_warmup.sql
+-- Warm-up plans ramping up the daily volume of new sending domains
+
+CREATE TABLE IF NOT EXISTS domain_warmups (
+  domain_id INTEGER PRIMARY KEY,
+  schedule TEXT NOT NULL, -- JSON array of daily message limits, day 1 first
+  started_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  FOREIGN KEY (domain_id) REFERENCES domains(id) ON DELETE CASCADE
+);
+
+-- Messages sent per domain and UTC day, counted against the warm-up limit
+CREATE TABLE IF NOT EXISTS domain_warmup_usage (
+  domain_id INTEGER NOT NULL,
+  day TEXT NOT NULL, -- YYYY-MM-DD
+  sent INTEGER NOT NULL DEFAULT 0,
+  PRIMARY KEY(domain_id, day),
+  FOREIGN KEY (domain_id) REFERENCES domains(id) ON DELETE CASCADE
+);
@@ -0,0 +1,5 @@
+-- SQLite Migration: 011_domain_tracking_host.sql
+-- Optional hostname for tracking and unsubscribe links in a domain's mail,
+-- a CNAME to the server's public host
+
+ALTER TABLE domains ADD COLUMN tracking_host TEXT;
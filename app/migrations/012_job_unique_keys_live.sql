@@ -0,0 +1,11 @@
+-- SQLite Migration: 012_job_unique_keys_live.sql
+-- A unique key only holds while its job is queued or running, so a key is
+-- free again once the job is done or dead-lettered
+
+DROP INDEX IF EXISTS idx_jobs_unique_key;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_jobs_unique_key ON jobs(unique_key)
+  WHERE unique_key IS NOT NULL AND status IN ('queued', 'running');
+
+-- Lookups of a key across all statuses
+CREATE INDEX IF NOT EXISTS idx_jobs_unique_key_all ON jobs(unique_key) WHERE unique_key IS NOT NULL;
@@ -0,0 +1,10 @@
+-- SQLite Migration: 013_job_campaign_id.sql
+-- The campaign a job belongs to, so a campaign's jobs can be found without
+-- scanning every payload
+
+ALTER TABLE jobs ADD COLUMN campaign_id INTEGER;
+
+UPDATE jobs SET campaign_id = json_extract(CAST(payload AS TEXT), '$.campaign_id')
+  WHERE type IN ('plan_campaign', 'send_batch');
+
+CREATE INDEX IF NOT EXISTS idx_jobs_campaign_id ON jobs(campaign_id, status) WHERE campaign_id IS NOT NULL;
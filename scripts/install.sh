@@ -308,6 +308,7 @@ services:
       - DATABASE_URL=sqlite:///var/app/newsletter.db
       - PORT=8080
       - LICENSE_KEY=$LICENSE_KEY
+      - TRUSTED_PROXIES=10.0.0.0/8,172.16.0.0/12,192.168.0.0/16
       - SMTP_HOST=mta
       - SMTP_PORT=587
       - DKIM_SELECTOR=$DKIM_SELECTOR